@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // uploaded references
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/screen"
+)
+
+const (
+	defaultReferenceDir  = "references"
+	referenceFileExt     = ".png"
+	maxReferenceSize     = 16 << 20 // bytes of uploaded images
+	analysisPollInterval = 200 * time.Millisecond
+
+	defaultWaitTimeout     = 60.0 // sec
+	defaultMatchTolerance  = 0.05
+	defaultStaticTolerance = 0.01
+)
+
+// names of reference images are file names in referenceDir without the extension
+var referenceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// ScreenState is the result of analysis of the latest frame.
+type ScreenState struct {
+	Time   time.Time    `json:"time"`
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Luma   screen.Stats `json:"luma"`
+	Black  bool         `json:"black"`
+	// Blank is true if the screen is filled with a color (e.g. "no signal" of capture devices)
+	Blank bool `json:"blank"`
+	// Changed is the time of the last change, only available if the monitor is running
+	Changed       *time.Time `json:"changed,omitempty"`
+	StaticSeconds float64    `json:"staticSeconds"`
+	Error         string     `json:"error,omitempty"`
+}
+
+type MatchResult struct {
+	Reference  string  `json:"reference"`
+	Difference float64 `json:"difference"`
+	Matched    bool    `json:"matched"`
+}
+
+type StaticResult struct {
+	Static        bool    `json:"static"`
+	StaticSeconds float64 `json:"staticSeconds"`
+}
+
+// ScreenMonitor analyzes frames periodically, so the state is available without waiting.
+type ScreenMonitor struct {
+	mutex   sync.Mutex
+	state   ScreenState
+	running bool
+}
+
+var screenMonitor = &ScreenMonitor{}
+
+func analyzeFrame(f *Frame) (ScreenState, image.Image, error) {
+	img, err := f.Image()
+	if err != nil {
+		return ScreenState{}, nil, err
+	}
+
+	b := img.Bounds()
+	luma := screen.Luma(img, b)
+
+	return ScreenState{
+		Time:   f.Time,
+		Width:  b.Dx(),
+		Height: b.Dy(),
+		Luma:   luma,
+		Black:  luma.IsBlack(),
+		Blank:  luma.IsBlank(),
+	}, img, nil
+}
+
+// Run analyzes a frame every interval. Frames are captured while the monitor is running.
+func (m *ScreenMonitor) Run(interval time.Duration) {
+	m.mutex.Lock()
+	m.running = true
+	m.mutex.Unlock()
+
+	detector := screen.ChangeDetector{Tolerance: defaultStaticTolerance}
+	last := time.Time{}
+	for {
+		f, err := frames.Next(last, frameTimeout)
+		if err != nil {
+			m.setState(ScreenState{Time: time.Now(), Error: err.Error()})
+			time.Sleep(interval)
+			continue
+		}
+		last = f.Time
+
+		state, img, err := analyzeFrame(f)
+		if err != nil {
+			state = ScreenState{Time: f.Time, Error: err.Error()}
+		} else {
+			changed := detector.Update(img, f.Time)
+			state.Changed = &changed
+			state.StaticSeconds = f.Time.Sub(changed).Seconds()
+		}
+		m.setState(state)
+
+		time.Sleep(interval)
+	}
+}
+
+func (m *ScreenMonitor) setState(s ScreenState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if s.Error != "" && m.state.Error == "" {
+		frames.Logger.Warnf("screen monitor: %s", s.Error)
+	}
+	m.state = s
+}
+
+// State returns the state of the monitor, or the state of the latest frame if the monitor is not running.
+func (m *ScreenMonitor) State() ScreenState {
+	m.mutex.Lock()
+	if m.running {
+		defer m.mutex.Unlock()
+		return m.state
+	}
+	m.mutex.Unlock()
+
+	f, err := frames.Latest(time.Second)
+	if err != nil {
+		return ScreenState{Time: time.Now(), Error: err.Error()}
+	}
+
+	state, _, err := analyzeFrame(f)
+	if err != nil {
+		return ScreenState{Time: f.Time, Error: err.Error()}
+	}
+
+	return state
+}
+
+func referencePath(name string) (string, error) {
+	if !referenceNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid reference name: %q", name)
+	}
+
+	return filepath.Join(config.ReferenceDir, name+referenceFileExt), nil
+}
+
+func loadReference(name string) (image.Image, error) {
+	path, err := referencePath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return img, nil
+}
+
+func saveReference(name string, img image.Image) error {
+	path, err := referencePath(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(config.ReferenceDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func listReferences() ([]string, error) {
+	files, err := ioutil.ReadDir(config.ReferenceDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	references := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), referenceFileExt) {
+			references = append(references, strings.TrimSuffix(f.Name(), referenceFileExt))
+		}
+	}
+	sort.Strings(references)
+
+	return references, nil
+}
+
+// matchFrame compares the region at the point of the frame with the reference.
+func matchFrame(f *Frame, name string, ref image.Image, at image.Point, tolerance float64) (MatchResult, error) {
+	img, err := f.Image()
+	if err != nil {
+		return MatchResult{}, err
+	}
+
+	d := screen.MatchAt(img, ref, at)
+
+	return MatchResult{Reference: name, Difference: d, Matched: d <= tolerance}, nil
+}
+
+// waitForMatch waits until the region at the point matches the reference.
+// Matched of the result is false on timeout. It returns an error if cancelled.
+func waitForMatch(name string, at image.Point, tolerance float64, timeout time.Duration, cancel <-chan struct{}) (MatchResult, error) {
+	ref, err := loadReference(name)
+	if err != nil {
+		return MatchResult{}, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	last := time.Time{}
+	for {
+		f, err := frames.Next(last, frameTimeout)
+		if err != nil {
+			return MatchResult{}, err
+		}
+		last = f.Time
+
+		result, err := matchFrame(f, name, ref, at, tolerance)
+		if err != nil || result.Matched || !time.Now().Before(deadline) {
+			return result, err
+		}
+
+		select {
+		case <-cancel:
+			return result, errors.New("cancelled")
+		case <-time.After(analysisPollInterval):
+		}
+	}
+}
+
+// waitForStatic waits until the screen does not change for the duration.
+// Static of the result is false on timeout. It returns an error if cancelled.
+func waitForStatic(static time.Duration, tolerance float64, timeout time.Duration, cancel <-chan struct{}) (StaticResult, error) {
+	detector := screen.ChangeDetector{Tolerance: tolerance}
+
+	deadline := time.Now().Add(timeout)
+	last := time.Time{}
+	for {
+		f, err := frames.Next(last, frameTimeout)
+		if err != nil {
+			return StaticResult{}, err
+		}
+		last = f.Time
+
+		img, err := f.Image()
+		if err != nil {
+			return StaticResult{}, err
+		}
+
+		staticTime := f.Time.Sub(detector.Update(img, f.Time))
+		result := StaticResult{Static: staticTime >= static, StaticSeconds: staticTime.Seconds()}
+		if result.Static || !time.Now().Before(deadline) {
+			return result, nil
+		}
+
+		select {
+		case <-cancel:
+			return result, errors.New("cancelled")
+		case <-time.After(analysisPollInterval):
+		}
+	}
+}
+
+// floatParam returns the query parameter as float, or the default value if not set.
+func floatParam(c echo.Context, name string, defaultValue float64) (float64, error) {
+	s := c.QueryParam(name)
+	if len(s) == 0 {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", name, s))
+	}
+
+	return v, nil
+}
+
+func intParam(c echo.Context, name string, defaultValue int) (int, error) {
+	v, err := floatParam(c, name, float64(defaultValue))
+	return int(v), err
+}
+
+// matchParams returns the reference, the position and the tolerance of the request.
+func matchParams(c echo.Context) (string, image.Point, float64, error) {
+	name := c.QueryParam("reference")
+	x, err := intParam(c, "x", 0)
+	if err != nil {
+		return "", image.Point{}, 0, err
+	}
+	y, err := intParam(c, "y", 0)
+	if err != nil {
+		return "", image.Point{}, 0, err
+	}
+	tolerance, err := floatParam(c, "tolerance", defaultMatchTolerance)
+	if err != nil {
+		return "", image.Point{}, 0, err
+	}
+
+	return name, image.Pt(x, y), tolerance, nil
+}
+
+func screenStateEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, screenMonitor.State())
+}
+
+func screenMatchEndpoint(c echo.Context) error {
+	name, at, tolerance, err := matchParams(c)
+	if err != nil {
+		return err
+	}
+
+	ref, err := loadReference(name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	f, err := frames.Latest(time.Second)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+
+	result, err := matchFrame(f, name, ref, at, tolerance)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func screenWaitMatchEndpoint(c echo.Context) error {
+	name, at, tolerance, err := matchParams(c)
+	if err != nil {
+		return err
+	}
+	timeout, err := floatParam(c, "timeout", defaultWaitTimeout)
+	if err != nil {
+		return err
+	}
+
+	result, err := waitForMatch(name, at, tolerance, time.Duration(timeout*float64(time.Second)), c.Request().Context().Done())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func screenWaitStaticEndpoint(c echo.Context) error {
+	seconds, err := floatParam(c, "seconds", 0)
+	if err != nil {
+		return err
+	}
+	tolerance, err := floatParam(c, "tolerance", defaultStaticTolerance)
+	if err != nil {
+		return err
+	}
+	timeout, err := floatParam(c, "timeout", defaultWaitTimeout)
+	if err != nil {
+		return err
+	}
+
+	result, err := waitForStatic(
+		time.Duration(seconds*float64(time.Second)),
+		tolerance,
+		time.Duration(timeout*float64(time.Second)),
+		c.Request().Context().Done(),
+	)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func referencesEndpoint(c echo.Context) error {
+	references, err := listReferences()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, references)
+}
+
+func referenceEndpoint(c echo.Context) error {
+	path, err := referencePath(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.File(path)
+}
+
+// putReferenceEndpoint stores the uploaded image (PNG or JPEG) as the reference.
+// If the body is empty, the region (x, y, w, h) of the current frame is stored.
+func putReferenceEndpoint(c echo.Context) error {
+	name := c.Param("name")
+	if _, err := referencePath(name); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, maxReferenceSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	var img image.Image
+	if len(body) > 0 {
+		img, _, err = image.Decode(bytes.NewReader(body))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	} else {
+		img, err = cropFrame(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = saveReference(name, img)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// cropFrame returns the region of the current frame in the request.
+func cropFrame(c echo.Context) (image.Image, error) {
+	var r [4]int
+	for i, name := range []string{"x", "y", "w", "h"} {
+		v, err := intParam(c, name, -1)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "x, y, w and h are required without image")
+		}
+		r[i] = v
+	}
+
+	f, err := frames.Latest(time.Second)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	img, err := f.Image()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	region := image.Rect(r[0], r[1], r[0]+r[2], r[1]+r[3])
+	if region.Empty() || !region.In(img.Bounds()) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "region is out of the screen")
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+
+	return cropped, nil
+}
+
+func deleteReferenceEndpoint(c echo.Context) error {
+	path, err := referencePath(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+const defaultCaptureTemplate = "default"
+
+// testInputFormat captures a test pattern without capture device.
+const testInputFormat = "test"
+
+// defaultCapture is tuned for a MJPEG capture dongle.
+var defaultCapture = ConfigCapture{
+	Name:         defaultCaptureTemplate,
+	VideoDevice:  "/dev/video0",
+	InputFormat:  "mjpeg",
+	ColorBalance: "brightness=0.053887 contrast=0.858824 saturation=0.875",
+	Encoder:      autoEncoder,
+	AudioDevice:  "hw:1",
+}
+
+// CaptureInput is the caps of an input format and elements to convert it.
+type CaptureInput struct {
+	Caps string
+	// V4L2 pixel format (FourCC)
+	PixelFormat string
+	// decoder to raw video
+	Decoder string
+	// encoder to JPEG for frames of snapshots and scripts
+	FrameEncoder string
+}
+
+var captureInputs = map[string]CaptureInput{
+	"mjpeg":         {Caps: "image/jpeg", PixelFormat: "MJPG", Decoder: "jpegdec"},
+	"yuy2":          {Caps: "video/x-raw,format=YUY2", PixelFormat: "YUYV", FrameEncoder: "jpegenc"},
+	"nv12":          {Caps: "video/x-raw,format=NV12", PixelFormat: "NV12", FrameEncoder: "jpegenc"},
+	testInputFormat: {Caps: "video/x-raw", FrameEncoder: "jpegenc"},
+}
+
+// default pipeline templates, they can be overridden in the capture template
+const (
+	videoSource          = `{{if eq .InputFormat "test"}}videotestsrc is-live=true{{else}}v4l2src device={{.VideoDevice}}{{end}}`
+	defaultVideoPipeline = videoSource +
+		" ! {{.Caps}},width={{.Width}},height={{.Height}},framerate={{.Framerate}}/1" +
+		" ! tee name=capture" +
+		" capture. ! queue leaky=downstream max-size-buffers=1{{with .FrameEncoder}} ! {{.}}{{end}}" +
+		" ! appsink name={{.FrameSink}} max-buffers=1 drop=true sync=false" +
+		" capture. ! queue{{with .Decoder}} ! {{.}}{{end}}" +
+		"{{with .ColorBalance}} ! videobalance {{.}}{{end}}" +
+		"{{with .Scaler}} ! {{.}}{{end}}" +
+		" ! videoconvert" +
+		" ! {{.Encoder}}{{with .Parser}} ! {{.}}{{end}} ! {{.EncodedCaps}}"
+	defaultFramePipeline = videoSource +
+		" ! {{.Caps}},width={{.Width}},height={{.Height}},framerate={{.Framerate}}/1" +
+		"{{with .FrameEncoder}} ! {{.}}{{end}}" +
+		" ! appsink name={{.FrameSink}} max-buffers=1 drop=true sync=false"
+	defaultAudioPipeline = `{{if eq .AudioDevice "test"}}audiotestsrc is-live=true wave=silence{{else}}alsasrc device={{.AudioDevice}}{{end}}` +
+		" ! audio/x-raw,format=S16LE,rate=48000,channels=2 ! audioconvert ! opusenc"
+)
+
+// CaptureParams are parameters of pipeline templates.
+type CaptureParams struct {
+	ConfigCapture
+	CaptureInput
+	Width     int
+	Height    int
+	Framerate int
+	Bitrate   int // bps
+	// negative padding to pad the video to a multiple of 16 (for templates without Scaler)
+	WidthPad  int
+	HeightPad int
+	// elements which scale, crop or pad the video in the scale mode (see VideoLayout)
+	Scaler    string
+	FrameSink string
+	// caps and parser of the encoded video
+	EncodedCaps string
+	Parser      string
+}
+
+// captureTemplate is the capture template selected in the config.
+var captureTemplate = defaultCapture
+
+// loadCaptureTemplate selects the capture template. Empty fields are filled with the default template.
+func loadCaptureTemplate() error {
+	if len(config.Capture) == 0 {
+		config.Capture = defaultCaptureTemplate
+	}
+
+	templates := append([]ConfigCapture{defaultCapture}, config.CaptureTemplates...)
+	found := false
+	for _, t := range templates {
+		if t.Name == config.Capture {
+			captureTemplate = t
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("capture template is not found: %s", config.Capture)
+	}
+
+	if len(captureTemplate.VideoDevice) == 0 {
+		captureTemplate.VideoDevice = defaultCapture.VideoDevice
+	}
+	if len(captureTemplate.InputFormat) == 0 {
+		captureTemplate.InputFormat = defaultCapture.InputFormat
+	}
+	if len(captureTemplate.Encoder) == 0 {
+		captureTemplate.Encoder = defaultCapture.Encoder
+	}
+	if len(captureTemplate.AudioDevice) == 0 {
+		captureTemplate.AudioDevice = defaultCapture.AudioDevice
+	}
+	if _, ok := captureInputs[captureTemplate.InputFormat]; !ok {
+		return fmt.Errorf("unsupported input format: %s", captureTemplate.InputFormat)
+	}
+
+	err := selectEncoder(captureTemplate.Encoder)
+	if err != nil {
+		return err
+	}
+
+	// check templates
+	for _, e := range codecEncoders {
+		_, err = videoPipeline(VideoRequest{Width: 1280, Height: 720, Framerate: 30, TargetBitrate: 1000}, e)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = framePipeline(1280, 720, 30)
+	if err != nil {
+		return err
+	}
+	_, err = audioPipeline()
+
+	return err
+}
+
+func renderPipeline(name, text string, data interface{}) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func captureParams(width, height, framerate, bitrate int) CaptureParams {
+	return CaptureParams{
+		ConfigCapture: captureTemplate,
+		CaptureInput:  captureInputs[captureTemplate.InputFormat],
+		Width:         width,
+		Height:        height,
+		Framerate:     framerate,
+		Bitrate:       bitrate,
+		WidthPad:      width - alignUp(width),
+		HeightPad:     height - alignUp(height),
+		FrameSink:     frameSinkName,
+	}
+}
+
+// videoPipeline returns the pipeline which captures and encodes video for sessions.
+func videoPipeline(v VideoRequest, e VideoEncoder) (string, error) {
+	p := captureParams(v.Width, v.Height, v.Framerate, v.TargetBitrate*1000)
+
+	layout, err := videoLayout(v.ScaleMode, v.Width, v.Height)
+	if err != nil {
+		return "", err
+	}
+	p.Scaler = layout.elements()
+
+	encoder, err := renderPipeline("encoder", e.Pipeline, encoderParams(p.Bitrate, p.Framerate))
+	if err != nil {
+		return "", err
+	}
+	codec := videoCodecs[e.MimeType]
+	p.Encoder = encoder
+	p.EncodedCaps = codec.Caps
+	p.Parser = codec.Parser
+
+	text := defaultVideoPipeline
+	if len(captureTemplate.Video) > 0 {
+		text = captureTemplate.Video
+	}
+
+	return renderPipeline("video", text, p)
+}
+
+// framePipeline returns the pipeline which captures JPEG frames without sessions.
+func framePipeline(width, height, framerate int) (string, error) {
+	p := captureParams(width, height, framerate, 0)
+
+	text := defaultFramePipeline
+	if len(captureTemplate.Frames) > 0 {
+		text = captureTemplate.Frames
+	}
+
+	return renderPipeline("frames", text, p)
+}
+
+// audioPipeline returns the pipeline which captures and encodes audio for sessions.
+func audioPipeline() (string, error) {
+	text := defaultAudioPipeline
+	if len(captureTemplate.Audio) > 0 {
+		text = captureTemplate.Audio
+	}
+
+	return renderPipeline("audio", text, CaptureParams{ConfigCapture: captureTemplate})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/v4l2"
+)
+
+const signalCheckInterval = 2 * time.Second
+
+// CaptureFormats are formats supported by the capture device.
+type CaptureFormats struct {
+	Device string `json:"device"`
+	v4l2.Capability
+	// pixel format of the input format of the capture template
+	PixelFormat string        `json:"pixelFormat"`
+	Formats     []v4l2.Format `json:"formats"`
+}
+
+// SignalState is the input signal of the capture device.
+type SignalState struct {
+	v4l2.Signal
+	// the device reports no signal, or the screen is blank while video is streamed (UVC devices show a "no signal" screen)
+	NoSignal bool      `json:"noSignal"`
+	Changed  time.Time `json:"changed"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// SignalMonitor checks the input signal periodically, and restarts the video stream when the source resolution changes.
+type SignalMonitor struct {
+	Logger echo.Logger
+
+	mutex sync.Mutex
+	state SignalState
+}
+
+var signalMonitor = &SignalMonitor{}
+
+// captureFormats enumerates formats of the device of the capture template.
+func captureFormats() (CaptureFormats, error) {
+	d, err := v4l2.Open(captureTemplate.VideoDevice)
+	if err != nil {
+		return CaptureFormats{}, err
+	}
+	defer d.Close()
+
+	capability, err := d.Capability()
+	if err != nil {
+		return CaptureFormats{}, err
+	}
+	formats, err := d.Formats()
+	if err != nil {
+		return CaptureFormats{}, err
+	}
+
+	return CaptureFormats{
+		Device:      captureTemplate.VideoDevice,
+		Capability:  capability,
+		PixelFormat: captureInputs[captureTemplate.InputFormat].PixelFormat,
+		Formats:     formats,
+	}, nil
+}
+
+// captureDeviceReady returns an error if the capture device can not be opened, e.g. it is unplugged.
+func captureDeviceReady() error {
+	d, err := v4l2.Open(captureTemplate.VideoDevice)
+	if err != nil {
+		return err
+	}
+
+	return d.Close()
+}
+
+// check returns the current signal.
+func (m *SignalMonitor) check() SignalState {
+	d, err := v4l2.Open(captureTemplate.VideoDevice)
+	if err != nil {
+		return SignalState{Error: err.Error()}
+	}
+	defer d.Close()
+
+	signal, err := d.Signal()
+	if err != nil {
+		return SignalState{Error: err.Error()}
+	}
+
+	state := SignalState{Signal: signal, NoSignal: signal.Detectable && !signal.Locked}
+	if !signal.Detectable && len(videoSubscribers()) > 0 {
+		state.NoSignal = screenMonitor.State().Blank
+	}
+
+	return state
+}
+
+// Run checks the signal every interval.
+func (m *SignalMonitor) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		m.update(m.check())
+	}
+}
+
+// update notifies viewers of changes, and restarts the video stream if the source has changed.
+func (m *SignalMonitor) update(state SignalState) {
+	m.mutex.Lock()
+	previous := m.state
+	state.Changed = previous.Changed
+	changed := state.NoSignal != previous.NoSignal || state.Error != previous.Error
+	if changed {
+		state.Changed = time.Now()
+	}
+	m.state = state
+	m.mutex.Unlock()
+
+	if state.Error != "" {
+		if changed {
+			m.Logger.Warnf("signal: %s", state.Error)
+		}
+		return
+	}
+
+	if changed {
+		m.Logger.Infof("signal: no signal: %t", state.NoSignal)
+		for _, c := range videoSubscribers() {
+			sendMessage(c.WS, "signal", state)
+		}
+	}
+
+	// the pipeline negotiates caps with the new timings
+	resized := previous.Locked && state.Locked &&
+		(state.Width != previous.Width || state.Height != previous.Height || state.Framerate != previous.Framerate)
+	recovered := previous.Detectable && !previous.Locked && state.Locked
+	if resized || recovered {
+		m.Logger.Infof("signal: source changed (%dx%d, %.2f fps), restarting video", state.Width, state.Height, state.Framerate)
+		err := restartVideo()
+		if err != nil {
+			m.Logger.Error(err)
+		}
+	}
+}
+
+// State returns the last checked signal.
+func (m *SignalMonitor) State() SignalState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.state
+}
+
+func captureFormatsEndpoint(c echo.Context) error {
+	if captureTemplate.InputFormat == testInputFormat {
+		return echo.NewHTTPError(http.StatusNotFound, "capture device is not used by the test input")
+	}
+
+	formats, err := captureFormats()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, formats)
+}
+
+func signalEndpoint(c echo.Context) error {
+	if captureTemplate.InputFormat == testInputFormat {
+		return echo.NewHTTPError(http.StatusNotFound, "capture device is not used by the test input")
+	}
+
+	return c.JSON(http.StatusOK, signalMonitor.State())
+}
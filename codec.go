@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	h264NALTypeIDR = 5
+	h264NALTypeSPS = 7
+	h264NALTypePPS = 8
+
+	av1OBUTypeSequenceHeader = 1
+)
+
+// VideoCodec is a codec of encoded video.
+type VideoCodec struct {
+	// caps of the encoded stream
+	Caps string
+	// parser after the encoder (optional)
+	Parser string
+	// IsKeyframe returns true if the frame can be decoded without other frames
+	IsKeyframe func(data []byte) bool
+}
+
+var videoCodecs = map[string]VideoCodec{
+	// SPS and PPS are sent with every keyframe for late joiners
+	webrtc.MimeTypeH264: {
+		Caps:       "video/x-h264,stream-format=byte-stream,alignment=au",
+		Parser:     "h264parse config-interval=-1",
+		IsKeyframe: isH264Keyframe,
+	},
+	webrtc.MimeTypeVP8: {Caps: "video/x-vp8", IsKeyframe: isVP8Keyframe},
+	webrtc.MimeTypeVP9: {Caps: "video/x-vp9", IsKeyframe: isVP9Keyframe},
+	webrtc.MimeTypeAV1: {
+		Caps:       "video/x-av1,stream-format=obu-stream,alignment=tu",
+		Parser:     "av1parse",
+		IsKeyframe: isAV1Keyframe,
+	},
+}
+
+// h264NALUnits splits an access unit of byte-stream into NAL units with start codes.
+func h264NALUnits(data []byte) [][]byte {
+	units := [][]byte{}
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		// 4 bytes start code
+		begin := i
+		if i > 0 && data[i-1] == 0 {
+			begin = i - 1
+		}
+		if start >= 0 {
+			units = append(units, data[start:begin])
+		}
+		start = begin
+		i += 2
+	}
+	if start >= 0 {
+		units = append(units, data[start:])
+	}
+
+	return units
+}
+
+func h264NALType(unit []byte) int {
+	for i := 0; i+1 < len(unit); i++ {
+		if unit[i] == 1 {
+			return int(unit[i+1] & 0x1f)
+		}
+	}
+
+	return 0
+}
+
+func isH264Keyframe(data []byte) bool {
+	for _, unit := range h264NALUnits(data) {
+		if h264NALType(unit) == h264NALTypeIDR {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isVP8Keyframe checks the P bit of the frame tag (RFC 6386 9.1).
+func isVP8Keyframe(data []byte) bool {
+	return len(data) > 0 && data[0]&0x01 == 0
+}
+
+// isVP9Keyframe checks show_existing_frame and frame_type of the uncompressed header.
+func isVP9Keyframe(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+
+	b := data[0]
+	profile := (b>>5)&0x01 | (b>>3)&0x02
+	shift := uint(3)
+	if profile == 3 {
+		// reserved_zero
+		shift = 2
+	}
+	showExistingFrame := (b >> shift) & 0x01
+	frameType := (b >> (shift - 1)) & 0x01
+
+	return showExistingFrame == 0 && frameType == 0
+}
+
+// isAV1Keyframe returns true if the temporal unit has a sequence header, which encoders send with key frames.
+func isAV1Keyframe(data []byte) bool {
+	for i := 0; i < len(data); {
+		header := data[i]
+		obuType := (header >> 3) & 0x0f
+		if obuType == av1OBUTypeSequenceHeader {
+			return true
+		}
+
+		i++
+		if header&0x04 != 0 {
+			// obu_extension_flag
+			i++
+		}
+		if header&0x02 == 0 {
+			// no obu_size, the last OBU
+			return false
+		}
+
+		// leb128
+		size := 0
+		for n := 0; n < 8 && i < len(data); n++ {
+			size |= int(data[i]&0x7f) << (7 * n)
+			i++
+			if data[i-1]&0x80 == 0 {
+				break
+			}
+		}
+		i += size
+	}
+
+	return false
+}
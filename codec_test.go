@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestH264NALUnits(t *testing.T) {
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42}
+	pps := []byte{0, 0, 1, 0x68, 0xce}
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x00}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		units [][]byte
+	}{
+		{"empty", nil, [][]byte{}},
+		{"no start code", []byte{0x65, 0x88}, [][]byte{}},
+		{"3 bytes start code", pps, [][]byte{pps}},
+		{"4 bytes start code", idr, [][]byte{idr}},
+		{"mixed start codes", concat(sps, pps, idr), [][]byte{sps, pps, idr}},
+		// a zero at the end of a unit is a part of the next 4 bytes start code
+		{"trailing zero", concat([]byte{0, 0, 1, 0x09, 0x10}, idr), [][]byte{{0, 0, 1, 0x09, 0x10}, idr}},
+	}
+
+	for _, tt := range tests {
+		units := h264NALUnits(tt.data)
+		if len(units) != len(tt.units) {
+			t.Errorf("%s: got %d units, want %d", tt.name, len(units), len(tt.units))
+			continue
+		}
+		for i := range units {
+			if !bytes.Equal(units[i], tt.units[i]) {
+				t.Errorf("%s: unit %d = %x, want %x", tt.name, i, units[i], tt.units[i])
+			}
+		}
+	}
+}
+
+func TestH264NALType(t *testing.T) {
+	tests := []struct {
+		unit []byte
+		want int
+	}{
+		{[]byte{0, 0, 0, 1, 0x67}, h264NALTypeSPS},
+		{[]byte{0, 0, 1, 0x68}, h264NALTypePPS},
+		{[]byte{0, 0, 0, 1, 0x65, 0x88}, h264NALTypeIDR},
+		{[]byte{0, 0, 1, 0x41}, 1},
+		{[]byte{0, 0, 1}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := h264NALType(tt.unit); got != tt.want {
+			t.Errorf("h264NALType(%x) = %d, want %d", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestIsH264Keyframe(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88}, true},
+		{[]byte{0, 0, 1, 0x65, 0x88}, true},
+		{[]byte{0, 0, 0, 1, 0x41, 0x9a}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isH264Keyframe(tt.data); got != tt.want {
+			t.Errorf("isH264Keyframe(%x) = %t, want %t", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestIsVP8Keyframe(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{[]byte{0x51, 0x42, 0x00}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isVP8Keyframe(tt.data); got != tt.want {
+			t.Errorf("isVP8Keyframe(%x) = %t, want %t", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestIsVP9Keyframe(t *testing.T) {
+	// frame_marker (2) profile_low_bit profile_high_bit [reserved_zero] show_existing_frame frame_type
+	tests := []struct {
+		name string
+		b    byte
+		want bool
+	}{
+		{"profile 0 key", 0x80, true},
+		{"profile 0 inter", 0x84, false},
+		{"profile 0 show existing", 0x88, false},
+		{"profile 1 key", 0xa0, true},
+		{"profile 1 inter", 0xa4, false},
+		{"profile 2 key", 0x90, true},
+		{"profile 2 inter", 0x94, false},
+		{"profile 3 key", 0xb0, true},
+		{"profile 3 inter", 0xb2, false},
+		{"profile 3 show existing", 0xb4, false},
+	}
+
+	for _, tt := range tests {
+		if got := isVP9Keyframe([]byte{tt.b, 0x49, 0x83}); got != tt.want {
+			t.Errorf("%s: isVP9Keyframe(%#x) = %t, want %t", tt.name, tt.b, got, tt.want)
+		}
+	}
+	if isVP9Keyframe(nil) {
+		t.Error("isVP9Keyframe(nil) = true, want false")
+	}
+}
+
+func TestIsAV1Keyframe(t *testing.T) {
+	// obu_header: forbidden (1) obu_type (4) extension_flag has_size_field reserved
+	const (
+		temporalDelimiter = 0x12 // type 2 with size
+		sequenceHeader    = 0x0a // type 1 with size
+		frame             = 0x32 // type 6 with size
+		frameExtension    = 0x36 // type 6 with extension and size
+	)
+	payload := bytes.Repeat([]byte{0xff}, 200)
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"key frame", concat([]byte{temporalDelimiter, 0}, []byte{sequenceHeader, 2, 0, 0}, []byte{frame, 1, 0x10}), true},
+		{"inter frame", concat([]byte{temporalDelimiter, 0}, []byte{frame, 2, 0x30, 0x00}), false},
+		// 200 bytes is encoded in 2 bytes of leb128
+		{"leb128 size", concat([]byte{frame, 0xc8, 0x01}, payload, []byte{sequenceHeader, 0}), true},
+		{"extension", concat([]byte{frameExtension, 0x00, 1, 0x30}, []byte{sequenceHeader, 0}), true},
+		// the last OBU without obu_size
+		{"no size field", []byte{0x30, 0x10, 0x0a}, false},
+		{"truncated", []byte{frame, 0x80}, false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isAV1Keyframe(tt.data); got != tt.want {
+			t.Errorf("%s: isAV1Keyframe(%x) = %t, want %t", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	data := []byte{}
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+
+	return data
+}
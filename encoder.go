@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/notedit/gst"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// encoder of the capture template which selects the first available encoder
+	autoEncoder  = "auto"
+	probeTimeout = 5 * time.Second
+	// keyframes are also sent when viewers join or request them
+	keyframeInterval = 2 // sec
+)
+
+// VideoEncoder is a backend of video encoding.
+type VideoEncoder struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Hardware bool   `json:"hardware"`
+	// template of encoder elements, parameters are EncoderParams
+	Pipeline string `json:"-"`
+	// SetBitrate changes the bitrate of the running encoder (named encoder), nil if it is not supported
+	SetBitrate func(encoder *gst.Element, bitrate int) `json:"-"`
+}
+
+// EncoderParams are parameters of encoder templates.
+type EncoderParams struct {
+	Bitrate     int // bps
+	BitrateKbps int
+	Framerate   int
+	// frames between keyframes
+	KeyframeInterval int
+}
+
+// EncoderStatus is the result of probing an encoder.
+type EncoderStatus struct {
+	VideoEncoder
+	Available bool `json:"available"`
+}
+
+// videoEncoders are known encoders in order of preference.
+var videoEncoders = []VideoEncoder{
+	{
+		Name:     "v4l2h264enc",
+		MimeType: webrtc.MimeTypeH264,
+		Hardware: true,
+		Pipeline: `v4l2h264enc name=encoder extra-controls="controls,video_bitrate={{.Bitrate}},h264_i_frame_period={{.KeyframeInterval}}"` +
+			" ! video/x-h264,level=(string)4",
+		SetBitrate: setV4L2Bitrate,
+	},
+	{
+		Name:       "omxh264enc",
+		MimeType:   webrtc.MimeTypeH264,
+		Hardware:   true,
+		Pipeline:   "omxh264enc name=encoder target-bitrate={{.Bitrate}} control-rate=1 interval-intraframes={{.KeyframeInterval}}",
+		SetBitrate: bitrateProperty("target-bitrate", 1, true),
+	},
+	{
+		Name:     "x264enc",
+		MimeType: webrtc.MimeTypeH264,
+		Pipeline: "x264enc name=encoder bitrate={{.BitrateKbps}} speed-preset=ultrafast tune=zerolatency key-int-max={{.KeyframeInterval}}" +
+			" ! video/x-h264,profile=constrained-baseline",
+		SetBitrate: bitrateProperty("bitrate", 1000, true),
+	},
+	{
+		Name:       "openh264enc",
+		MimeType:   webrtc.MimeTypeH264,
+		Pipeline:   "openh264enc name=encoder bitrate={{.Bitrate}} gop-size={{.KeyframeInterval}} complexity=low",
+		SetBitrate: bitrateProperty("bitrate", 1, true),
+	},
+	{
+		Name:     "vp8enc",
+		MimeType: webrtc.MimeTypeVP8,
+		Pipeline: "vp8enc name=encoder target-bitrate={{.Bitrate}} keyframe-max-dist={{.KeyframeInterval}}" +
+			" deadline=1 cpu-used=8 end-usage=cbr error-resilient=partitions",
+		SetBitrate: bitrateProperty("target-bitrate", 1, false),
+	},
+	{
+		Name:     "vp9enc",
+		MimeType: webrtc.MimeTypeVP9,
+		Pipeline: "vp9enc name=encoder target-bitrate={{.Bitrate}} keyframe-max-dist={{.KeyframeInterval}}" +
+			" deadline=1 cpu-used=8 end-usage=cbr",
+		SetBitrate: bitrateProperty("target-bitrate", 1, false),
+	},
+	{
+		Name:     "av1enc",
+		MimeType: webrtc.MimeTypeAV1,
+		Pipeline: "av1enc name=encoder target-bitrate={{.BitrateKbps}} keyframe-max-dist={{.KeyframeInterval}}" +
+			" cpu-used=10 end-usage=cbr usage-profile=realtime",
+		SetBitrate: bitrateProperty("target-bitrate", 1000, true),
+	},
+	{
+		Name:     "rav1enc",
+		MimeType: webrtc.MimeTypeAV1,
+		// the bitrate can not be changed while encoding
+		Pipeline: "rav1enc name=encoder bitrate={{.Bitrate}} max-key-frame-interval={{.KeyframeInterval}} speed-preset=10 low-latency=true",
+	},
+}
+
+// codecEncoders are encoders used by video streams, the first available encoder of each codec in order of preference.
+var codecEncoders []VideoEncoder
+
+// encoderStatus is the result of probing at startup.
+var encoderStatus []EncoderStatus
+
+// bitrateProperty returns SetBitrate which sets the bitrate in bps divided by unit to the property.
+func bitrateProperty(name string, unit int, unsigned bool) func(*gst.Element, int) {
+	return func(encoder *gst.Element, bitrate int) {
+		if unsigned {
+			encoder.SetObject(name, uint32(bitrate/unit))
+		} else {
+			encoder.SetObject(name, bitrate/unit)
+		}
+	}
+}
+
+// setV4L2Bitrate sets the bitrate control of the device.
+func setV4L2Bitrate(encoder *gst.Element, bitrate int) {
+	controls := gst.NewStructure("controls")
+	controls.SetValue("video_bitrate", bitrate)
+	encoder.SetObject("extra-controls", controls)
+}
+
+// encoderParams returns parameters of the encoder template.
+func encoderParams(bitrate, framerate int) EncoderParams {
+	return EncoderParams{
+		Bitrate:          bitrate,
+		BitrateKbps:      bitrate / 1000,
+		Framerate:        framerate,
+		KeyframeInterval: framerate * keyframeInterval,
+	}
+}
+
+// probeEncoder encodes a test pattern with the encoder.
+func probeEncoder(e VideoEncoder) bool {
+	encoder, err := renderPipeline(e.Name, e.Pipeline, encoderParams(1000000, 30))
+	if err != nil {
+		return false
+	}
+
+	pipeline, err := gst.ParseLaunch(
+		"videotestsrc num-buffers=30 ! video/x-raw,width=640,height=480,framerate=30/1 ! videoconvert ! " +
+			encoder + " ! appsink name=probe sync=false",
+	)
+	if err != nil {
+		return false
+	}
+	defer pipeline.SetState(gst.StateNull)
+
+	sink := pipeline.GetByName("probe")
+	pipeline.SetState(gst.StatePlaying)
+
+	pulled := make(chan bool, 1)
+	go func() {
+		_, err := sink.PullSample()
+		pulled <- err == nil
+	}()
+
+	select {
+	case ok := <-pulled:
+		return ok
+	case <-time.After(probeTimeout):
+		return false
+	}
+}
+
+// findEncoder returns the known encoder by name.
+func findEncoder(name string) (VideoEncoder, bool) {
+	for _, e := range videoEncoders {
+		if e.Name == name {
+			return e, true
+		}
+	}
+
+	return VideoEncoder{}, false
+}
+
+// findCodecEncoder returns the encoder of the codec.
+func findCodecEncoder(mimeType string) (VideoEncoder, bool) {
+	for _, e := range codecEncoders {
+		if strings.EqualFold(e.MimeType, mimeType) {
+			return e, true
+		}
+	}
+
+	return VideoEncoder{}, false
+}
+
+// selectEncoder selects encoders of the capture template.
+// The encoder is the name of a known encoder, auto to select available encoders, or a template of H.264 encoder elements.
+func selectEncoder(name string) error {
+	if name != autoEncoder {
+		e, ok := findEncoder(name)
+		if !ok {
+			e = VideoEncoder{Name: "custom", MimeType: webrtc.MimeTypeH264, Pipeline: name}
+		}
+		codecEncoders = []VideoEncoder{e}
+		return nil
+	}
+
+	encoderStatus = []EncoderStatus{}
+	codecEncoders = []VideoEncoder{}
+	for _, e := range videoEncoders {
+		available := probeEncoder(e)
+		encoderStatus = append(encoderStatus, EncoderStatus{VideoEncoder: e, Available: available})
+		if _, found := findCodecEncoder(e.MimeType); available && !found {
+			codecEncoders = append(codecEncoders, e)
+		}
+	}
+	if len(codecEncoders) == 0 {
+		return fmt.Errorf("no video encoder is available")
+	}
+
+	return nil
+}
+
+// encodersEndpoint returns encoders of codecs and results of probing.
+func encodersEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, struct {
+		Encoders []VideoEncoder  `json:"encoders"`
+		Probed   []EncoderStatus `json:"probed"`
+	}{
+		Encoders: codecEncoders,
+		Probed:   encoderStatus,
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/screen"
+	"github.com/notedit/gst"
+)
+
+const (
+	// capture settings of the standalone pipeline (used when no session is capturing)
+	standaloneWidth     = 1280
+	standaloneHeight    = 720
+	standaloneFramerate = 30
+
+	frameSourceIdleTimeout = 10 * time.Second
+	frameTimeout           = 5 * time.Second
+)
+
+// frameSinkName is the name of appsink which receives JPEG frames in capture pipelines.
+const frameSinkName = "frames"
+
+// Frame is a JPEG frame captured from the capture device.
+type Frame struct {
+	JPEG []byte
+	Time time.Time
+
+	once  sync.Once
+	image image.Image
+	err   error
+}
+
+// FrameSource shares frames of the capture device.
+// Frames are pushed by the pipeline of the WebRTC session.
+// If no session is capturing, a standalone pipeline runs while frames are requested.
+type FrameSource struct {
+	Logger echo.Logger
+
+	mutex    sync.Mutex
+	frame    *Frame
+	updated  chan struct{}
+	sessions int
+	lastUsed time.Time
+	// stop is closed to stop the standalone pipeline, nil if it is not running
+	stop           chan struct{}
+	standaloneDone chan struct{}
+}
+
+var frames = NewFrameSource()
+
+// Image returns the decoded frame.
+func (f *Frame) Image() (image.Image, error) {
+	f.once.Do(func() {
+		f.image, f.err = screen.DecodeMJPEG(f.JPEG)
+	})
+
+	return f.image, f.err
+}
+
+func NewFrameSource() *FrameSource {
+	return &FrameSource{updated: make(chan struct{})}
+}
+
+// Push sets the latest frame and notifies waiters.
+func (s *FrameSource) Push(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.frame = &Frame{JPEG: data, Time: time.Now()}
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// Next returns a frame captured after the time.
+func (s *FrameSource) Next(after time.Time, timeout time.Duration) (*Frame, error) {
+	deadline := time.After(timeout)
+
+	for {
+		s.mutex.Lock()
+		s.lastUsed = time.Now()
+		if s.frame != nil && s.frame.Time.After(after) {
+			f := s.frame
+			s.mutex.Unlock()
+			return f, nil
+		}
+		if s.sessions == 0 && s.stop == nil {
+			s.startStandalone()
+		}
+		updated := s.updated
+		s.mutex.Unlock()
+
+		select {
+		case <-updated:
+		case <-deadline:
+			return nil, errors.New("no frame is captured")
+		}
+	}
+}
+
+// Latest returns the latest frame if it is not older than maxAge, otherwise it waits for the next frame.
+func (s *FrameSource) Latest(maxAge time.Duration) (*Frame, error) {
+	return s.Next(time.Now().Add(-maxAge), frameTimeout)
+}
+
+// AcquireSession is called before a session pipeline opens the capture device.
+// The standalone pipeline is stopped to release the device.
+func (s *FrameSource) AcquireSession() {
+	s.mutex.Lock()
+	s.sessions++
+	stop, done := s.stop, s.standaloneDone
+	s.stop = nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// ReleaseSession is called after a session pipeline has stopped.
+func (s *FrameSource) ReleaseSession() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions--
+}
+
+// PullFrom pushes frames from the appsink until the pipeline stops.
+func (s *FrameSource) PullFrom(sink *gst.Element) {
+	for {
+		// appsink returns no sample after EOS or when the pipeline is stopped
+		sample, err := sink.PullSample()
+		if err != nil {
+			return
+		}
+		s.Push(sample.Data)
+	}
+}
+
+// startStandalone must be called with the lock.
+func (s *FrameSource) startStandalone() {
+	s.stop = make(chan struct{})
+	s.standaloneDone = make(chan struct{})
+	go s.runStandalone(s.stop, s.standaloneDone)
+}
+
+// idle returns true if no frame is requested recently.
+func (s *FrameSource) idle() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return time.Since(s.lastUsed) > frameSourceIdleTimeout
+}
+
+func (s *FrameSource) runStandalone(stop, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		s.mutex.Lock()
+		if s.stop == stop {
+			s.stop = nil
+		}
+		s.mutex.Unlock()
+	}()
+
+	pipelineStr, err := framePipeline(standaloneWidth, standaloneHeight, standaloneFramerate)
+	if err != nil {
+		s.Logger.Error(err)
+		return
+	}
+
+	pipeline, err := gst.ParseLaunch(pipelineStr)
+	if err != nil {
+		s.Logger.Error(err)
+		return
+	}
+
+	sink := pipeline.GetByName(frameSinkName)
+	pipeline.SetState(gst.StatePlaying)
+	s.Logger.Info("standalone capture started")
+
+	// stop the pipeline when requested, idle or failed. PullSample returns when the pipeline is stopped.
+	pulled := make(chan struct{})
+	go func() {
+		bus := pipeline.GetBus()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+	loop:
+		for {
+			select {
+			case <-stop:
+				break loop
+			case <-pulled:
+				break loop
+			case <-ticker.C:
+				if s.idle() {
+					break loop
+				}
+				if failed := checkBusError(bus, s.Logger); failed {
+					break loop
+				}
+			}
+		}
+		pipeline.SetState(gst.StateNull)
+	}()
+
+	s.PullFrom(sink)
+	close(pulled)
+	s.Logger.Info("standalone capture stopped")
+}
+
+// checkBusError logs error messages on the bus and returns true if an error is found.
+func checkBusError(bus *gst.Bus, logger echo.Logger) bool {
+	failed := false
+	for bus.HavePending() {
+		m := bus.Pop()
+		if m == nil {
+			break
+		}
+		if m.GetType() == gst.MessageError {
+			logger.Errorf("capture pipeline error: %s", m.GetStructure().ToString())
+			failed = true
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,41 @@
+package main
+
+// #cgo pkg-config: gstreamer-1.0 gstreamer-video-1.0
+// #include <gst/gst.h>
+// #include <gst/video/video.h>
+//
+// static gboolean request_key_unit(GstElement *element) {
+//   return gst_element_send_event(element, gst_video_event_new_upstream_force_key_unit(GST_CLOCK_TIME_NONE, TRUE, 0));
+// }
+//
+// static char *parse_error_message(GstMessage *message) {
+//   GError *err = NULL;
+//   gchar *debug = NULL;
+//   char *text;
+//   gst_message_parse_error(message, &err, &debug);
+//   text = g_strdup(err != NULL ? err->message : "");
+//   g_clear_error(&err);
+//   g_free(debug);
+//   return text;
+// }
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/notedit/gst"
+)
+
+// requestKeyUnit sends a force-key-unit event upstream from the element.
+// The encoder emits a keyframe with SPS and PPS.
+func requestKeyUnit(element *gst.Element) bool {
+	return C.request_key_unit((*C.GstElement)(unsafe.Pointer(element.GstElement))) != 0
+}
+
+// errorMessage returns the message of the GError in the error message.
+func errorMessage(m *gst.Message) string {
+	text := C.parse_error_message((*C.GstMessage)(unsafe.Pointer(m.C)))
+	defer C.g_free(C.gpointer(unsafe.Pointer(text)))
+
+	return C.GoString(text)
+}
@@ -0,0 +1,138 @@
+package keymap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stroke is a key press on the target keyboard.
+type Stroke struct {
+	Code  int // usage ID (in Keyboard/Keypad Page)
+	Shift bool
+	AltGr bool
+}
+
+// Modifiers returns usage IDs of modifier keys to be pressed with the key.
+func (s Stroke) Modifiers() []int {
+	modifiers := []int{}
+	if s.Shift {
+		modifiers = append(modifiers, usages["ShiftLeft"])
+	}
+	if s.AltGr {
+		modifiers = append(modifiers, usages["AltRight"])
+	}
+
+	return modifiers
+}
+
+// Layout converts characters into strokes for a keyboard layout of the target.
+type Layout struct {
+	Name  string
+	chars map[rune][]Stroke
+}
+
+type keyDef struct {
+	code  int
+	base  string
+	shift string
+	altGr string
+	// characters of this key which are dead keys (e.g. "^" on German layout)
+	dead string
+}
+
+type layoutDef struct {
+	name string
+	keys []keyDef
+}
+
+var layouts = map[string]*Layout{}
+
+func init() {
+	for _, d := range []layoutDef{layoutUS, layoutUK, layoutDE, layoutFR, layoutJIS} {
+		layouts[d.name] = newLayout(d)
+	}
+}
+
+func newLayout(d layoutDef) *Layout {
+	l := &Layout{
+		Name:  d.name,
+		chars: map[rune][]Stroke{},
+	}
+
+	dead := map[rune]Stroke{}
+	add := func(s string, stroke Stroke, k keyDef) {
+		for _, r := range s {
+			if strings.ContainsRune(k.dead, r) {
+				if _, ok := dead[r]; !ok {
+					dead[r] = stroke
+				}
+				continue
+			}
+			// first definition wins
+			if _, ok := l.chars[r]; !ok {
+				l.chars[r] = []Stroke{stroke}
+			}
+		}
+	}
+
+	for _, k := range append(commonKeys, d.keys...) {
+		add(k.base, Stroke{Code: k.code}, k)
+		add(k.shift, Stroke{Code: k.code, Shift: true}, k)
+		add(k.altGr, Stroke{Code: k.code, AltGr: true}, k)
+	}
+
+	// dead keys produce the character itself when followed by a space
+	for r, s := range dead {
+		if _, ok := l.chars[r]; !ok {
+			l.chars[r] = []Stroke{s, {Code: keySpace}}
+		}
+	}
+
+	// composed characters (e.g. "â" = "^" + "a")
+	for accent, composed := range compositions {
+		s, ok := dead[accent]
+		if !ok {
+			continue
+		}
+		for base, c := range composed {
+			if _, ok := l.chars[c]; ok {
+				continue
+			}
+			baseStrokes, ok := l.chars[base]
+			if !ok {
+				continue
+			}
+			l.chars[c] = append([]Stroke{s}, baseStrokes...)
+		}
+	}
+
+	return l
+}
+
+// Strokes returns strokes to type the character.
+func (l *Layout) Strokes(r rune) ([]Stroke, bool) {
+	s, ok := l.chars[r]
+	return s, ok
+}
+
+// Get returns the layout by name (e.g. "us", "jis").
+func Get(name string) (*Layout, error) {
+	l, ok := layouts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyboard layout: %s", name)
+	}
+
+	return l, nil
+}
+
+// Names returns names of supported layouts.
+func Names() []string {
+	names := []string{}
+	for n := range layouts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,94 @@
+package keymap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStrokes(t *testing.T) {
+	space := Stroke{Code: keySpace}
+
+	tests := []struct {
+		layout string
+		char   rune
+		want   []Stroke
+	}{
+		{"us", 'a', []Stroke{{Code: 0x04}}},
+		{"us", 'A', []Stroke{{Code: 0x04, Shift: true}}},
+		{"us", '@', []Stroke{{Code: 0x1f, Shift: true}}},
+		{"us", '\n', []Stroke{{Code: keyEnter}}},
+		{"uk", '@', []Stroke{{Code: 0x34, Shift: true}}},
+		{"uk", '£', []Stroke{{Code: 0x20, Shift: true}}},
+		{"uk", '\\', []Stroke{{Code: 0x64}}},
+		// QWERTZ
+		{"de", 'z', []Stroke{{Code: 0x1c}}},
+		{"de", 'y', []Stroke{{Code: 0x1d}}},
+		{"de", '@', []Stroke{{Code: 0x14, AltGr: true}}},
+		{"de", 'ß', []Stroke{{Code: 0x2d}}},
+		{"de", '^', []Stroke{{Code: 0x35}, space}},
+		{"de", 'â', []Stroke{{Code: 0x35}, {Code: 0x04}}},
+		{"de", 'É', []Stroke{{Code: 0x2e}, {Code: 0x08, Shift: true}}},
+		{"de", 'ü', []Stroke{{Code: 0x2f}}},
+		// AZERTY
+		{"fr", 'a', []Stroke{{Code: 0x14}}},
+		{"fr", 'q', []Stroke{{Code: 0x04}}},
+		{"fr", 'm', []Stroke{{Code: 0x33}}},
+		{"fr", '1', []Stroke{{Code: 0x1e, Shift: true}}},
+		{"fr", 'é', []Stroke{{Code: 0x1f}}},
+		{"fr", 'ê', []Stroke{{Code: 0x2f}, {Code: 0x08}}},
+		{"fr", 'ë', []Stroke{{Code: 0x2f, Shift: true}, {Code: 0x08}}},
+		{"fr", '~', []Stroke{{Code: 0x1f, AltGr: true}, space}},
+		{"fr", 'ñ', []Stroke{{Code: 0x1f, AltGr: true}, {Code: 0x11}}},
+		{"jis", '_', []Stroke{{Code: 0x87, Shift: true}}},
+		{"jis", '\\', []Stroke{{Code: 0x87}}},
+		{"jis", '|', []Stroke{{Code: 0x89, Shift: true}}},
+		{"jis", '@', []Stroke{{Code: 0x2f}}},
+		{"jis", ':', []Stroke{{Code: 0x34}}},
+	}
+
+	for _, tt := range tests {
+		l, err := Get(tt.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := l.Strokes(tt.char)
+		if !ok {
+			t.Errorf("%s: %q is not available", tt.layout, tt.char)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Strokes(%q) = %+v, want %+v", tt.layout, tt.char, got, tt.want)
+		}
+	}
+}
+
+func TestStrokesNotAvailable(t *testing.T) {
+	tests := []struct {
+		layout string
+		char   rune
+	}{
+		{"us", 'é'},
+		{"us", 'â'},
+		{"jis", 'ê'},
+		{"de", 'ñ'},
+	}
+
+	for _, tt := range tests {
+		l, err := Get(tt.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, ok := l.Strokes(tt.char); ok {
+			t.Errorf("%s: Strokes(%q) = %+v, want not available", tt.layout, tt.char, s)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	if !reflect.DeepEqual(Names(), []string{"de", "fr", "jis", "uk", "us"}) {
+		t.Errorf("Names() = %v", Names())
+	}
+	if _, err := Get("dvorak"); err == nil {
+		t.Error("Get(\"dvorak\") is not an error")
+	}
+}
@@ -0,0 +1,198 @@
+package keymap
+
+import "strings"
+
+const (
+	keyEnter = 0x28
+	keyTab   = 0x2b
+	keySpace = 0x2c
+)
+
+// keys which are the same on all layouts
+var commonKeys = []keyDef{
+	{keyEnter, "\n", "", "", ""},
+	{keyTab, "\t", "", "", ""},
+	{keySpace, " ", "", "", ""},
+}
+
+// letterKeys returns definitions of letter keys (usage 0x04 - 0x1d).
+// letters are characters of each key in order of the usage ID, "-" means the key is not a letter.
+func letterKeys(letters string) []keyDef {
+	keys := []keyDef{}
+	for i, r := range letters {
+		if r == '-' {
+			continue
+		}
+		keys = append(keys, keyDef{0x04 + i, string(r), strings.ToUpper(string(r)), "", ""})
+	}
+
+	return keys
+}
+
+var layoutUS = layoutDef{
+	name: "us",
+	keys: append(letterKeys("abcdefghijklmnopqrstuvwxyz"), []keyDef{
+		{0x1e, "1", "!", "", ""},
+		{0x1f, "2", "@", "", ""},
+		{0x20, "3", "#", "", ""},
+		{0x21, "4", "$", "", ""},
+		{0x22, "5", "%", "", ""},
+		{0x23, "6", "^", "", ""},
+		{0x24, "7", "&", "", ""},
+		{0x25, "8", "*", "", ""},
+		{0x26, "9", "(", "", ""},
+		{0x27, "0", ")", "", ""},
+		{0x2d, "-", "_", "", ""},
+		{0x2e, "=", "+", "", ""},
+		{0x2f, "[", "{", "", ""},
+		{0x30, "]", "}", "", ""},
+		{0x31, "\\", "|", "", ""},
+		{0x33, ";", ":", "", ""},
+		{0x34, "'", "\"", "", ""},
+		{0x35, "`", "~", "", ""},
+		{0x36, ",", "<", "", ""},
+		{0x37, ".", ">", "", ""},
+		{0x38, "/", "?", "", ""},
+	}...),
+}
+
+var layoutUK = layoutDef{
+	name: "uk",
+	keys: append(letterKeys("abcdefghijklmnopqrstuvwxyz"), []keyDef{
+		{0x1e, "1", "!", "", ""},
+		{0x1f, "2", "\"", "", ""},
+		{0x20, "3", "£", "", ""},
+		{0x21, "4", "$", "€", ""},
+		{0x22, "5", "%", "", ""},
+		{0x23, "6", "^", "", ""},
+		{0x24, "7", "&", "", ""},
+		{0x25, "8", "*", "", ""},
+		{0x26, "9", "(", "", ""},
+		{0x27, "0", ")", "", ""},
+		{0x2d, "-", "_", "", ""},
+		{0x2e, "=", "+", "", ""},
+		{0x2f, "[", "{", "", ""},
+		{0x30, "]", "}", "", ""},
+		{0x32, "#", "~", "", ""},
+		{0x33, ";", ":", "", ""},
+		{0x34, "'", "@", "", ""},
+		{0x35, "`", "¬", "¦", ""},
+		{0x64, "\\", "|", "", ""},
+		{0x36, ",", "<", "", ""},
+		{0x37, ".", ">", "", ""},
+		{0x38, "/", "?", "", ""},
+	}...),
+}
+
+var layoutDE = layoutDef{
+	name: "de",
+	keys: append(letterKeys("abcdefghijklmnopqrstuvwxzy"), []keyDef{
+		{0x14, "", "", "@", ""},
+		{0x08, "", "", "€", ""},
+		{0x10, "", "", "µ", ""},
+		{0x1e, "1", "!", "", ""},
+		{0x1f, "2", "\"", "²", ""},
+		{0x20, "3", "§", "³", ""},
+		{0x21, "4", "$", "", ""},
+		{0x22, "5", "%", "", ""},
+		{0x23, "6", "&", "", ""},
+		{0x24, "7", "/", "{", ""},
+		{0x25, "8", "(", "[", ""},
+		{0x26, "9", ")", "]", ""},
+		{0x27, "0", "=", "}", ""},
+		{0x2d, "ß", "?", "\\", ""},
+		{0x2e, "´", "`", "", "´`"},
+		{0x2f, "ü", "Ü", "", ""},
+		{0x30, "+", "*", "~", ""},
+		{0x32, "#", "'", "", ""},
+		{0x33, "ö", "Ö", "", ""},
+		{0x34, "ä", "Ä", "", ""},
+		{0x35, "^", "°", "", "^"},
+		{0x64, "<", ">", "|", ""},
+		{0x36, ",", ";", "", ""},
+		{0x37, ".", ":", "", ""},
+		{0x38, "-", "_", "", ""},
+	}...),
+}
+
+var layoutFR = layoutDef{
+	name: "fr",
+	keys: append(letterKeys("qbcdefghijkl-noparstuvzxyw"), []keyDef{
+		{0x08, "", "", "€", ""},
+		{0x1e, "&", "1", "", ""},
+		{0x1f, "é", "2", "~", "~"},
+		{0x20, "\"", "3", "#", ""},
+		{0x21, "'", "4", "{", ""},
+		{0x22, "(", "5", "[", ""},
+		{0x23, "-", "6", "|", ""},
+		{0x24, "è", "7", "`", "`"},
+		{0x25, "_", "8", "\\", ""},
+		{0x26, "ç", "9", "^", ""},
+		{0x27, "à", "0", "@", ""},
+		{0x2d, ")", "°", "]", ""},
+		{0x2e, "=", "+", "}", ""},
+		{0x2f, "^", "¨", "", "^¨"},
+		{0x30, "$", "£", "¤", ""},
+		{0x32, "*", "µ", "", ""},
+		{0x33, "m", "M", "", ""},
+		{0x34, "ù", "%", "", ""},
+		{0x35, "²", "", "", ""},
+		{0x64, "<", ">", "", ""},
+		{0x10, ",", "?", "", ""},
+		{0x36, ";", ".", "", ""},
+		{0x37, ":", "/", "", ""},
+		{0x38, "!", "§", "", ""},
+	}...),
+}
+
+var layoutJIS = layoutDef{
+	name: "jis",
+	keys: append(letterKeys("abcdefghijklmnopqrstuvwxyz"), []keyDef{
+		{0x1e, "1", "!", "", ""},
+		{0x1f, "2", "\"", "", ""},
+		{0x20, "3", "#", "", ""},
+		{0x21, "4", "$", "", ""},
+		{0x22, "5", "%", "", ""},
+		{0x23, "6", "&", "", ""},
+		{0x24, "7", "'", "", ""},
+		{0x25, "8", "(", "", ""},
+		{0x26, "9", ")", "", ""},
+		{0x27, "0", "", "", ""},
+		{0x2d, "-", "=", "", ""},
+		{0x2e, "^", "~", "", ""},
+		{0x2f, "@", "`", "", ""},
+		{0x30, "[", "{", "", ""},
+		{0x32, "]", "}", "", ""},
+		{0x33, ";", "+", "", ""},
+		{0x34, ":", "*", "", ""},
+		{0x36, ",", "<", "", ""},
+		{0x37, ".", ">", "", ""},
+		{0x38, "/", "?", "", ""},
+		{0x87, "\\", "_", "", ""}, // International1 (Ro)
+		{0x89, "¥", "|", "", ""},  // International3 (Yen)
+	}...),
+}
+
+// characters composed with dead keys
+var compositions = map[rune]map[rune]rune{
+	'^': {
+		'a': 'â', 'e': 'ê', 'i': 'î', 'o': 'ô', 'u': 'û',
+		'A': 'Â', 'E': 'Ê', 'I': 'Î', 'O': 'Ô', 'U': 'Û',
+	},
+	'¨': {
+		'a': 'ä', 'e': 'ë', 'i': 'ï', 'o': 'ö', 'u': 'ü', 'y': 'ÿ',
+		'A': 'Ä', 'E': 'Ë', 'I': 'Ï', 'O': 'Ö', 'U': 'Ü',
+	},
+	'´': {
+		'a': 'á', 'e': 'é', 'i': 'í', 'o': 'ó', 'u': 'ú', 'y': 'ý',
+		'A': 'Á', 'E': 'É', 'I': 'Í', 'O': 'Ó', 'U': 'Ú', 'Y': 'Ý',
+	},
+	'`': {
+		'a': 'à', 'e': 'è', 'i': 'ì', 'o': 'ò', 'u': 'ù',
+		'A': 'À', 'E': 'È', 'I': 'Ì', 'O': 'Ò', 'U': 'Ù',
+	},
+	'~': {
+		'a': 'ã', 'o': 'õ', 'n': 'ñ',
+		'A': 'Ã', 'O': 'Õ', 'N': 'Ñ',
+	},
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/usbgadget"
+)
+
+const (
+	defaultMacroDir = "macros"
+	macroFileExt    = ".json"
+	maxMacroSpeed   = 100.0
+	// recording is stopped at these limits
+	maxMacroEvents = 100000
+	maxMacroLength = 30 * time.Minute
+)
+
+var macroNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// input events to be recorded
+var macroEventTypes = map[string]bool{
+	"mouseEvent":    true,
+	"mouseAbsEvent": true,
+	"touchEvent":    true,
+	"keyDown":       true,
+	"keyUp":         true,
+	"releaseAll":    true,
+}
+
+type MacroEvent struct {
+	Time int64 `json:"time"` // msec from the start of recording
+	WSRequest
+}
+
+type Macro struct {
+	Name     string       `json:"name"`
+	Recorded time.Time    `json:"recorded"`
+	Events   []MacroEvent `json:"events"`
+}
+
+type MacroInfo struct {
+	Name     string    `json:"name"`
+	Recorded time.Time `json:"recorded"`
+	Events   int       `json:"events"`
+	Length   int64     `json:"length"` // msec
+}
+
+type MacroRecorder struct {
+	macro Macro
+	start time.Time
+}
+
+type MacroRequest struct {
+	Name  string  `json:"name"`
+	Speed float64 `json:"speed"` // 1 is the original timing
+}
+
+type MacroResult struct {
+	Name      string `json:"name"`
+	Played    int    `json:"played"`
+	Total     int    `json:"total"`
+	Done      bool   `json:"done"`
+	Cancelled bool   `json:"cancelled"`
+	Error     string `json:"error,omitempty"`
+}
+
+func NewMacroRecorder(name string) *MacroRecorder {
+	now := time.Now()
+	return &MacroRecorder{
+		macro: Macro{Name: name, Recorded: now, Events: []MacroEvent{}},
+		start: now,
+	}
+}
+
+// Add records the request if it is an input event.
+// It returns false if the recording has reached the limit of events or length, the request is not recorded.
+func (r *MacroRecorder) Add(req WSRequest) bool {
+	elapsed := time.Since(r.start)
+	if len(r.macro.Events) >= maxMacroEvents || elapsed > maxMacroLength {
+		return false
+	}
+	if !macroEventTypes[req.MessageType] {
+		return true
+	}
+
+	r.macro.Events = append(r.macro.Events, MacroEvent{Time: elapsed.Milliseconds(), WSRequest: req})
+
+	return true
+}
+
+func (m *Macro) Info() MacroInfo {
+	info := MacroInfo{Name: m.Name, Recorded: m.Recorded, Events: len(m.Events)}
+	if len(m.Events) > 0 {
+		info.Length = m.Events[len(m.Events)-1].Time
+	}
+
+	return info
+}
+
+func macroPath(name string) (string, error) {
+	if !macroNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid macro name: %q", name)
+	}
+
+	return filepath.Join(config.MacroDir, name+macroFileExt), nil
+}
+
+func saveMacro(m *Macro) error {
+	path, err := macroPath(m.Name)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(config.MacroDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+func loadMacro(name string) (*Macro, error) {
+	path, err := macroPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Macro
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m.Name = name
+
+	return &m, nil
+}
+
+func deleteMacro(name string) error {
+	path, err := macroPath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func listMacros() ([]MacroInfo, error) {
+	files, err := ioutil.ReadDir(config.MacroDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []MacroInfo{}, nil
+		}
+		return nil, err
+	}
+
+	macros := []MacroInfo{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), macroFileExt) {
+			continue
+		}
+
+		m, err := loadMacro(strings.TrimSuffix(f.Name(), macroFileExt))
+		if err != nil {
+			continue
+		}
+		macros = append(macros, m.Info())
+	}
+	sort.Slice(macros, func(i, j int) bool { return macros[i].Name < macros[j].Name })
+
+	return macros, nil
+}
+
+// replayEvent sends the recorded event to the device.
+func replayEvent(c *KVMContext, e MacroEvent) error {
+	switch e.MessageType {
+	case "mouseEvent":
+		var m MouseEvent
+		json.Unmarshal(e.Payload, &m)
+		return sendMouseEvent(c, m)
+	case "mouseAbsEvent":
+		var m MouseAbsEvent
+		json.Unmarshal(e.Payload, &m)
+		return sendMouseAbsEvent(c, m)
+	case "touchEvent":
+		var t TouchEvent
+		json.Unmarshal(e.Payload, &t)
+		return sendTouchEvent(c, t)
+	case "keyDown", "keyUp":
+		var k KeyboardEvent
+		json.Unmarshal(e.Payload, &k)
+		return sendKeyboardEvent(c, e.MessageType, k)
+	case "releaseAll":
+		return releaseAllKeys(c)
+	}
+
+	return nil
+}
+
+// playMacro replays events of the macro on devices of the session. The timing is scaled by 1/speed.
+// It runs on another goroutine than the session, and stops if the session turns off USB.
+func playMacro(c *KVMContext, m *Macro, speed float64, j *TypeJob) MacroResult {
+	r := MacroResult{Name: m.Name, Total: len(m.Events)}
+	if speed <= 0 {
+		speed = 1
+	}
+
+	// handlers of messages use devices taken by the player, not fields of the session
+	d := c.usbDevices()
+	player := &KVMContext{USBDevices: d, Echo: c.Echo, WS: c.WS}
+	wakeupIfSuspended(player)
+
+	// the last positions of absolute events, to release buttons at the end
+	var lastAbs MouseAbsEvent
+	var lastTouch TouchEvent
+
+	start := time.Now()
+	for _, e := range m.Events {
+		wait := time.Until(start.Add(time.Duration(float64(e.Time)/speed) * time.Millisecond))
+		select {
+		case <-j.cancel:
+			r.Cancelled = true
+		case <-time.After(wait):
+		}
+		if r.Cancelled {
+			break
+		}
+		if c.usbDevices().Usb != d.Usb {
+			r.Error = "USB gadget is stopped"
+			break
+		}
+
+		switch e.MessageType {
+		case "mouseAbsEvent":
+			json.Unmarshal(e.Payload, &lastAbs)
+		case "touchEvent":
+			json.Unmarshal(e.Payload, &lastTouch)
+		}
+		if err := replayEvent(player, e); err != nil {
+			// the rest of the macro is meaningless without the event
+			if errors.Is(err, usbgadget.ErrQueueFull) {
+				r.Error = err.Error()
+				break
+			}
+			onHIDError(player, err)
+		}
+		r.Played++
+	}
+	r.Done = !r.Cancelled && len(r.Error) == 0
+
+	// do not leave keys and buttons pressed
+	if d.Keyboard != nil && d.Keyboard.IsPressed() {
+		d.Keyboard.ReleaseAll()
+	}
+	if d.Mouse != nil {
+		d.Mouse.Send(0, 0, 0)
+	}
+	if d.MouseAbs != nil && lastAbs.Buttons != 0 {
+		d.MouseAbs.Send(0, int(lastAbs.Pos.X), int(lastAbs.Pos.Y))
+	}
+	if d.TouchScreen != nil && lastTouch.Buttons != 0 {
+		d.TouchScreen.Send(0, int(lastTouch.Pos.X), int(lastTouch.Pos.Y))
+	}
+
+	return r
+}
+
+func checkMacroSpeed(speed float64) error {
+	if speed < 0 || speed > maxMacroSpeed {
+		return fmt.Errorf("invalid speed: %v", speed)
+	}
+
+	return nil
+}
+
+func onMacroRecordStart(c *KVMContext, wsReq WSRequest) {
+	var r MacroRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	if _, err := macroPath(r.Name); err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	c.Recorder = NewMacroRecorder(r.Name)
+	c.Echo.Logger().Info("start recording macro: " + r.Name)
+}
+
+func stopMacroRecording(c *KVMContext) error {
+	if c.Recorder == nil {
+		return nil
+	}
+
+	m := c.Recorder.macro
+	c.Recorder = nil
+	c.Echo.Logger().Infof("stop recording macro: %s (%d events)", m.Name, len(m.Events))
+
+	return saveMacro(&m)
+}
+
+// onMacroRecordLimit saves the recording which has reached the limit, and notifies the client.
+func onMacroRecordLimit(c *KVMContext, wsReq WSRequest) {
+	name := c.Recorder.macro.Name
+	c.Echo.Logger().Warnf("macro recording reached the limit (%d events or %v): %s", maxMacroEvents, maxMacroLength, name)
+	sendMessage(c.WS, "macroRecordStopped", MacroRequest{Name: name})
+
+	onMacroRecordStop(c, wsReq)
+}
+
+func onMacroRecordStop(c *KVMContext, wsReq WSRequest) {
+	err := stopMacroRecording(c)
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	onMacroListRequest(c, wsReq)
+}
+
+func onMacroListRequest(c *KVMContext, wsReq WSRequest) {
+	macros, err := listMacros()
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	sendMessage(c.WS, "macros", macros)
+}
+
+func onMacroPlayRequest(c *KVMContext, wsReq WSRequest) {
+	var r MacroRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	if c.Usb == nil {
+		sendError(c.WS, "USB gadget is not enabled")
+		return
+	}
+
+	if err := checkMacroSpeed(r.Speed); err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	m, err := loadMacro(r.Name)
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	j, err := startTypeJob(typeJobMacro, m.Name)
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	go func() {
+		defer finishTypeJob(j)
+
+		result := playMacro(c, m, r.Speed, j)
+		sendMessage(c.WS, "macroResult", result)
+		c.Echo.Logger().Infof("play macro: %+v", result)
+	}()
+}
+
+func cancelMacroEndpoint(c echo.Context) error {
+	if !cancelTypeJob(typeJobMacro, c.Param("name")) {
+		return echo.NewHTTPError(http.StatusNotFound, "macro is not playing: "+c.Param("name"))
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func onMacroCancel(c *KVMContext, wsReq WSRequest) {
+	cancelTypeJob(typeJobMacro, "")
+}
+
+func macrosEndpoint(c echo.Context) error {
+	macros, err := listMacros()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, macros)
+}
+
+func macroEndpoint(c echo.Context) error {
+	m, err := loadMacro(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, m)
+}
+
+func deleteMacroEndpoint(c echo.Context) error {
+	err := deleteMacro(c.Param("name"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func playMacroEndpoint(c echo.Context) error {
+	r := MacroRequest{Name: c.Param("name"), Speed: 1}
+	if s := c.QueryParam("speed"); len(s) > 0 {
+		speed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		r.Speed = speed
+	}
+	if err := checkMacroSpeed(r.Speed); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	m, err := loadMacro(r.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+
+	owner, _ := ownerDevices()
+	if owner == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "USB gadget is not enabled")
+	}
+
+	j, err := startTypeJob(typeJobMacro, m.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	defer finishTypeJob(j)
+
+	// cancel if the client has gone
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			j.Cancel()
+		case <-done:
+		}
+	}()
+
+	result := playMacro(owner, m, r.Speed, j)
+
+	return c.JSON(http.StatusOK, result)
+}
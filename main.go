@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,15 +11,16 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"github.com/msawahara/ipkvm/keymap"
 	"github.com/msawahara/ipkvm/usbgadget"
-	"github.com/notedit/gst"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"golang.org/x/net/websocket"
 	"gopkg.in/yaml.v2"
 )
@@ -28,33 +30,96 @@ type ConfigCommand struct {
 	Command string `yaml:"command"`
 }
 
+// ConfigCapture is a template of pipelines for a capture device.
+type ConfigCapture struct {
+	Name        string `yaml:"name"`
+	VideoDevice string `yaml:"videoDevice"`
+	// mjpeg, yuy2 or nv12
+	InputFormat string `yaml:"inputFormat"`
+	// properties of videobalance, empty disables color correction
+	ColorBalance string `yaml:"colorBalance"`
+	// H.264 encoder, {{.Bitrate}} is replaced with the target bitrate (bps)
+	Encoder     string `yaml:"encoder"`
+	AudioDevice string `yaml:"audioDevice"`
+	// templates overriding whole pipelines (optional)
+	Video  string `yaml:"video"`
+	Audio  string `yaml:"audio"`
+	Frames string `yaml:"frames"`
+}
+
+// ConfigPreset is a named key combination.
+// Keys are KeyboardEvent.code values pressed together, Sequence is chords sent in order instead of Keys.
+// If Duration is set, the chords are repeated every Interval until Duration has elapsed.
+type ConfigPreset struct {
+	Name     string     `yaml:"name" json:"name"`
+	Keys     []string   `yaml:"keys" json:"keys,omitempty"`
+	Sequence [][]string `yaml:"sequence" json:"sequence,omitempty"`
+	Interval int        `yaml:"interval" json:"interval,omitempty"` // msec
+	Duration int        `yaml:"duration" json:"duration,omitempty"` // msec
+}
+
 type Config struct {
 	ListenAddress string   `yaml:"listenAddress"`
 	IceServers    []string `yaml:"iceServers"`
 	Default       struct {
 		RemoteVideo   bool `yaml:"remoteVideo"`
 		RelativeMouse bool `yaml:"relativeMouse"`
+		HighResMouse  bool `yaml:"highResolutionMouse"`
 		AbsoluteMouse bool `yaml:"absoluteMouse"`
 		TouchScreen   bool `yaml:"touchScreen"`
 		Keyboard      bool `yaml:"keyboard"`
 		Gamepad       bool `yaml:"gamepad"`
+		MassStorage   bool `yaml:"massStorage"`
 	} `yaml:"default"`
-	Commands []ConfigCommand `yaml:"commands"`
+	Commands       []ConfigCommand `yaml:"commands"`
+	Presets        []ConfigPreset  `yaml:"presets"`
+	KeyboardLayout string          `yaml:"keyboardLayout"`
+	MacroDir       string          `yaml:"macroDir"`
+	ScriptDir      string          `yaml:"scriptDir"`
+	MediaDir       string          `yaml:"mediaDir"`
+	ReferenceDir   string          `yaml:"referenceDir"`
+	// interval of the screen monitor (msec), 0 disables the monitor
+	ScreenMonitorInterval int `yaml:"screenMonitorInterval"`
+	Timeline              struct {
+		Dir string `yaml:"dir"`
+		// interval of thumbnails (sec), 0 disables the timeline
+		Interval  int `yaml:"interval"`
+		Width     int `yaml:"width"`
+		MaxFrames int `yaml:"maxFrames"`
+	} `yaml:"timeline"`
+	Recording struct {
+		Dir string `yaml:"dir"`
+		// mp4 or mkv
+		Format string `yaml:"format"`
+		// record while video is streamed without starting recording
+		Always bool `yaml:"always"`
+		// duration of a file (min)
+		Segment int `yaml:"segment"`
+		// total size of files (MB), 0 is unlimited
+		MaxSize int `yaml:"maxSize"`
+		// days to keep files, 0 is unlimited
+		RetentionDays int `yaml:"retentionDays"`
+	} `yaml:"recording"`
+	// name of the capture template
+	Capture          string          `yaml:"capture"`
+	CaptureTemplates []ConfigCapture `yaml:"captureTemplates"`
+}
+
+type TemplateData struct {
+	Config
+	Layouts []string
+	Presets []ConfigPreset
 }
 
 type KeyboardEvent struct {
-	Code     []int `json:"code"`
-	AltKey   bool  `json:"altKey"`
-	CtrlKey  bool  `json:"ctrlKey"`
-	MetaKey  bool  `json:"metaKey"`
-	ShiftKey bool  `json:"shiftKey"`
+	Code string `json:"code"` // KeyboardEvent.code
 }
 
 type MouseEvent struct {
 	Buttons int `json:"buttons"`
 	Pos     struct {
-		X int `json:"x"`
-		Y int `json:"y"`
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
 	} `json:"pos"`
 }
 
@@ -76,15 +141,27 @@ type VideoRequest struct {
 	Height        int  `json:"height"`
 	Framerate     int  `json:"framerate"`
 	TargetBitrate int  `json:"targetBitrate"`
+	// fit, pad, crop or native (empty is fit)
+	ScaleMode string `json:"scaleMode"`
+	// preferred codec (MIME type, empty is automatic)
+	Codec string `json:"codec"`
+	// MIME types of codecs supported by the browser
+	Codecs []string `json:"codecs"`
+}
+
+type DevicesRequest struct {
+	Mouse        bool `json:"mouse"`
+	MouseHighRes bool `json:"mouseHighResolution"`
+	MouseAbs     bool `json:"mouseAbs"`
+	TouchScreen  bool `json:"touchScreen"`
+	Keyboard     bool `json:"keyboard"`
+	Gamepad      bool `json:"gamepad"`
+	MassStorage  bool `json:"massStorage"`
 }
 
 type InitRequest struct {
 	RemoteVideo VideoRequest `json:"remoteVideo"`
-	Mouse       bool         `json:"mouse"`
-	MouseAbs    bool         `json:"mouseAbs"`
-	TouchScreen bool         `json:"touchScreen"`
-	Keyboard    bool         `json:"keyboard"`
-	Gamepad     bool         `json:"gamepad"`
+	DevicesRequest
 }
 
 type WSRequest struct {
@@ -92,27 +169,42 @@ type WSRequest struct {
 	Payload     json.RawMessage `json:"payload"`
 }
 
-type TrackContext struct {
-	Track *webrtc.TrackLocalStaticSample
-	Stop  chan struct{}
+type ErrorMessage struct {
+	Message string `json:"message"`
 }
 
-type KVMContext struct {
+// USBDevices are devices of the USB gadget of a session.
+// They are replaced by the session with usbOwnerMutex, other goroutines must take them by usbDevices.
+type USBDevices struct {
 	Usb         *usbgadget.USBGadget
 	Mouse       *usbgadget.USBGadgetMouse
 	MouseAbs    *usbgadget.USBGadgetMouseAbsolute
 	TouchScreen *usbgadget.USBGadgetTouchScreen
 	Keyboard    *usbgadget.USBGadgetKeyboard
 	Gamepad     *usbgadget.USBGadgetGamePad
-	Echo        echo.Context
-	WS          *websocket.Conn
-	PC          *webrtc.PeerConnection
-	AudioTrack  *TrackContext
-	VideoTrack  *TrackContext
+	MassStorage *usbgadget.USBGadgetMassStorage
 }
 
+type KVMContext struct {
+	USBDevices
+	Devices  DevicesRequest
+	Echo     echo.Context
+	WS       *websocket.Conn
+	PC       *webrtc.PeerConnection
+	Recorder *MacroRecorder
+}
+
+const usbGadgetName = "g0"
+
+// wsReadTimeout is 3 times of keepAlive interval of the client.
+const wsReadTimeout = 30 * time.Second
+
 var config Config
 
+// usbOwner is the session which has the USB gadget enabled
+var usbOwner *KVMContext
+var usbOwnerMutex sync.Mutex
+
 func sendOffer(ws *websocket.Conn, offer webrtc.SessionDescription) error {
 	offerJson, err := json.Marshal(offer)
 	if err != nil {
@@ -128,70 +220,73 @@ func sendOffer(ws *websocket.Conn, offer webrtc.SessionDescription) error {
 	return err
 }
 
-func writeSamplesFromGst(c *TrackContext, name, pipelineStr string, logger echo.Logger) {
-	pipeline, err := gst.ParseLaunch(fmt.Sprintf("%s ! appsink name=%s", pipelineStr, name))
+func sendMessage(ws *websocket.Conn, messageType string, payload interface{}) error {
+	payloadJson, err := json.Marshal(payload)
 	if err != nil {
-		logger.Error(err)
-		return
+		return err
 	}
 
-	element := pipeline.GetByName(name)
-	pipeline.SetState(gst.StatePlaying)
-
-	defer func() {
-		pipeline.SetState(gst.StateNull)
-		logger.Infof("stream closed (name: %s)", name)
-	}()
-
-	count := 0
-	for {
-		sample, err := element.PullSample()
-		if err != nil {
-			if element.IsEOS() {
-				break
-			} else {
-				logger.Error(err)
-			}
-		}
-
-		if count == 0 {
-			logger.Infof("write first sample to stream (name: %s)", name)
-		}
-		logger.Debugf("write sample (name: %s, count: %d, duration: %d)", name, count, sample.Duration)
-
-		err = c.Track.WriteSample(media.Sample{Data: sample.Data, Duration: time.Duration(sample.Duration)})
-		if err != nil {
-			logger.Error(err)
-		}
+	req := WSRequest{
+		MessageType: messageType,
+		Payload:     payloadJson,
+	}
+	err = websocket.JSON.Send(ws, req)
 
-		count++
+	return err
+}
 
-		select {
-		case <-c.Stop:
-			return
-		default:
-			// NOP
-		}
-	}
+func sendError(ws *websocket.Conn, message string) error {
+	return sendMessage(ws, "error", ErrorMessage{Message: message})
 }
 
-func newTrackGst(name, mimeType, pipelineStr string, logger echo.Logger) *TrackContext {
-	track := new(TrackContext)
-	track.Track, _ = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, name, name)
-	track.Stop = make(chan struct{})
+func OnICEConnectionClose(c *KVMContext) {
+	audioStream.Unsubscribe(c)
+	unsubscribeVideo(c)
+}
 
-	go writeSamplesFromGst(track, name, pipelineStr, logger)
+// addStream subscribes the stream and adds its track to the peer connection.
+func addStream(c *KVMContext, s *MediaStream, pipelineStr string) {
+	track, err := s.Subscribe(c, pipelineStr, 0)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		return
+	}
 
-	return track
+	sender, err := c.PC.AddTrack(track)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		return
+	}
+	go readRTCP(c, s, sender)
+	sendMessage(c.WS, "streamState", s.State())
 }
 
-func OnICEConnectionClose(c *KVMContext) {
-	if c.AudioTrack != nil {
-		close(c.AudioTrack.Stop)
+// addVideoStream subscribes the video stream of the codec selected for the session, and tells its settings to the client.
+// The estimator adapts the bitrate of the stream to the bandwidth of the session.
+func addVideoStream(c *KVMContext, v VideoRequest, estimator cc.BandwidthEstimator) {
+	track, settings, err := subscribeVideo(c, v)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		sendError(c.WS, err.Error())
+		return
 	}
 
-	if c.VideoTrack != nil {
-		close(c.VideoTrack.Stop)
+	sender, err := c.PC.AddTrack(track)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		return
+	}
+	s := videoStreams[settings.Encoder.MimeType]
+	go readRTCP(c, s, sender)
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(func(bitrate int) {
+			s.SetEstimate(c, "twcc", bitrate)
+		})
+	}
+	sendMessage(c.WS, "videoSettings", settings)
+	sendMessage(c.WS, "streamState", s.State())
+	if captureTemplate.InputFormat != testInputFormat {
+		sendMessage(c.WS, "signal", signalMonitor.State())
 	}
 }
 
@@ -204,7 +299,13 @@ func initWebRTC(c *KVMContext, v VideoRequest) {
 		},
 	}
 
-	c.PC, _ = webrtc.NewPeerConnection(config)
+	pc, estimator, err := newPeerConnection(config, v.TargetBitrate*1000)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		sendError(c.WS, err.Error())
+		return
+	}
+	c.PC = pc
 
 	c.PC.OnICEConnectionStateChange(func(s webrtc.ICEConnectionState) {
 		c.Echo.Logger().Infof("OnIceConnectionStateChange: %s", s.String())
@@ -214,6 +315,13 @@ func initWebRTC(c *KVMContext, v VideoRequest) {
 		}
 	})
 
+	// media can be sent once both ICE and DTLS are connected
+	c.PC.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateConnected {
+			requestSubscriberKeyframe(c)
+		}
+	})
+
 	c.PC.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate != nil {
 			c.Echo.Logger().Debugf("OnIceCandidate: %s", candidate.String())
@@ -228,39 +336,14 @@ func initWebRTC(c *KVMContext, v VideoRequest) {
 		}
 	})
 
-	c.AudioTrack = newTrackGst(
-		"audio",
-		"audio/opus",
-		"alsasrc device=hw:1 ! audio/x-raw,format=S16LE,rate=48000,channels=2 ! audioconvert ! opusenc",
-		c.Echo.Logger(),
-	)
-	c.PC.AddTrack(c.AudioTrack.Track)
-
-	blockSize := 16
-	widthPad := (blockSize - (v.Width % blockSize)) % blockSize
-	heightPad := (blockSize - (v.Height % blockSize)) % blockSize
-
-	c.VideoTrack = newTrackGst(
-		"video",
-		"video/h264",
-		fmt.Sprintf(
-			"v4l2src device=/dev/video0"+
-				" ! image/jpeg,width=%d,height=%d,framerate=%d/1"+
-				" ! jpegdec"+
-				" ! videobalance brightness=0.053887 contrast=0.858824 saturation=0.875"+
-				" ! videobox right=%d bottom=%d"+
-				" ! videoconvert"+
-				" ! omxh264enc target-bitrate=%d control-rate=1",
-			v.Width,
-			v.Height,
-			v.Framerate,
-			-widthPad,
-			-heightPad,
-			v.TargetBitrate*1000,
-		),
-		c.Echo.Logger(),
-	)
-	c.PC.AddTrack(c.VideoTrack.Track)
+	audio, err := audioPipeline()
+	if err != nil {
+		c.Echo.Logger().Error(err)
+	} else {
+		addStream(c, audioStream, audio)
+	}
+
+	addVideoStream(c, v, estimator)
 
 	offer, _ := c.PC.CreateOffer(nil)
 	c.PC.SetLocalDescription(offer)
@@ -291,25 +374,151 @@ func onInitRequest(c *KVMContext, wsReq WSRequest) {
 		initWebRTC(c, r.RemoteVideo)
 	}
 
-	enableUsb := r.Mouse || r.MouseAbs || r.TouchScreen || r.Keyboard || r.Gamepad
-	if enableUsb {
-		c.Usb = usbgadget.NewUSBGadget("g0")
-		if r.Mouse {
-			c.Mouse = c.Usb.AddMouse("mouse")
-		}
-		if r.MouseAbs {
-			c.MouseAbs = c.Usb.AddMouseAbsolute("mouseAbs")
-		}
-		if r.TouchScreen {
-			c.TouchScreen = c.Usb.AddTouchScreen("touchScreen")
-		}
-		if r.Keyboard {
-			c.Keyboard = c.Usb.AddKeyboard("keyboard")
-		}
-		if r.Gamepad {
-			c.Gamepad = c.Usb.AddGamePad("gamepad")
-		}
-		c.Usb.Start()
+	startUsb(c, r.DevicesRequest)
+	sendMessage(c.WS, "devices", c.Devices)
+}
+
+// onVideoSettingsRequest changes settings of the video stream without renegotiation.
+func onVideoSettingsRequest(c *KVMContext, wsReq WSRequest) {
+	var r VideoRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	settings, subscribers, err := changeVideoSettings(c, r)
+	if err != nil {
+		c.Echo.Logger().Error(err)
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	// settings are shared by all viewers
+	for _, s := range subscribers {
+		sendMessage(s.WS, "videoSettings", settings)
+	}
+}
+
+// usbDevices returns devices of the session for goroutines other than the session (macros and scripts).
+// Devices which are stopped meanwhile return errors.
+func (c *KVMContext) usbDevices() USBDevices {
+	usbOwnerMutex.Lock()
+	defer usbOwnerMutex.Unlock()
+
+	return c.USBDevices
+}
+
+// ownerDevices returns the session which owns the USB gadget and its devices, nil if USB is not enabled.
+func ownerDevices() (*KVMContext, USBDevices) {
+	usbOwnerMutex.Lock()
+	defer usbOwnerMutex.Unlock()
+
+	if usbOwner == nil {
+		return nil, USBDevices{}
+	}
+
+	return usbOwner, usbOwner.USBDevices
+}
+
+func startUsb(c *KVMContext, r DevicesRequest) {
+	enableUsb := r.Mouse || r.MouseAbs || r.TouchScreen || r.Keyboard || r.Gamepad || r.MassStorage
+	if !enableUsb {
+		return
+	}
+
+	usbOwnerMutex.Lock()
+	defer usbOwnerMutex.Unlock()
+
+	c.Usb = usbgadget.NewUSBGadget(usbGadgetName)
+	if r.Mouse && r.MouseHighRes {
+		c.Mouse = c.Usb.AddMouseHighResolution("mouse")
+	} else if r.Mouse {
+		c.Mouse = c.Usb.AddMouse("mouse")
+	}
+	if r.MouseAbs {
+		c.MouseAbs = c.Usb.AddMouseAbsolute("mouseAbs")
+	}
+	if r.TouchScreen {
+		c.TouchScreen = c.Usb.AddTouchScreen("touchScreen")
+	}
+	if r.Keyboard {
+		c.Keyboard = c.Usb.AddKeyboard("keyboard")
+	}
+	if r.Gamepad {
+		c.Gamepad = c.Usb.AddGamePad("gamepad")
+	}
+	if r.MassStorage {
+		c.MassStorage = c.Usb.AddMassStorage("media")
+	}
+	c.Usb.Start()
+
+	c.Devices = r
+	usbOwner = c
+}
+
+func stopUsb(c *KVMContext) {
+	usbOwnerMutex.Lock()
+	defer usbOwnerMutex.Unlock()
+
+	if c.Usb == nil {
+		return
+	}
+
+	if usbOwner == c {
+		usbOwner = nil
+	}
+
+	// pressed keys are released by the host when the gadget is unbound from UDC
+	c.Usb.Stop()
+	c.USBDevices = USBDevices{}
+	c.Devices = DevicesRequest{}
+}
+
+// onDevicesRequest reconfigures the USB gadget. Remote video is not affected.
+func onDevicesRequest(c *KVMContext, wsReq WSRequest) {
+	var r DevicesRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	if r == c.Devices {
+		sendMessage(c.WS, "devices", c.Devices)
+		return
+	}
+
+	c.Echo.Logger().Infof("reconfigure USB gadget: %+v", r)
+	stopUsb(c)
+	startUsb(c, r)
+	sendMessage(c.WS, "devices", c.Devices)
+}
+
+func wakeupIfSuspended(c *KVMContext) {
+	if c.Usb == nil || !c.Usb.IsSuspended() {
+		return
+	}
+
+	c.Echo.Logger().Info("host is suspended, send remote wakeup")
+	err := c.Usb.Wakeup()
+	if err != nil {
+		c.Echo.Logger().Error(err)
+	}
+}
+
+func onWakeupRequest(c *KVMContext, wsReq WSRequest) {
+	if c.Usb == nil {
+		c.Echo.Logger().Error("wakeup: USB gadget is not enabled")
+		return
+	}
+
+	c.Echo.Logger().Info("send remote wakeup")
+	err := c.Usb.Wakeup()
+	if err != nil {
+		c.Echo.Logger().Error(err)
+	}
+}
+
+func onHIDError(c *KVMContext, err error) {
+	c.Echo.Logger().Error(err)
+
+	if errors.Is(err, usbgadget.ErrDeviceNotReady) || errors.Is(err, usbgadget.ErrFunctionNotFound) {
+		sendError(c.WS, "HID device not ready")
+	} else {
+		sendError(c.WS, err.Error())
 	}
 }
 
@@ -317,8 +526,8 @@ func onMouseEvent(c *KVMContext, wsReq WSRequest) {
 	var e MouseEvent
 	json.Unmarshal(wsReq.Payload, &e)
 
-	if c.Mouse != nil {
-		c.Mouse.Send(e.Buttons, e.Pos.X, e.Pos.Y)
+	if err := sendMouseEvent(c, e); err != nil {
+		onHIDError(c, err)
 	}
 }
 
@@ -326,8 +535,8 @@ func onMouseAbsEvent(c *KVMContext, wsReq WSRequest) {
 	var e MouseAbsEvent
 	json.Unmarshal(wsReq.Payload, &e)
 
-	if c.MouseAbs != nil {
-		c.MouseAbs.Send(e.Buttons, e.Pos.X, e.Pos.Y)
+	if err := sendMouseAbsEvent(c, e); err != nil {
+		onHIDError(c, err)
 	}
 }
 
@@ -335,8 +544,8 @@ func onTouchEvent(c *KVMContext, wsReq WSRequest) {
 	var e TouchEvent
 	json.Unmarshal(wsReq.Payload, &e)
 
-	if c.TouchScreen != nil {
-		c.TouchScreen.Send(e.Buttons, e.Pos.X, e.Pos.Y)
+	if err := sendTouchEvent(c, e); err != nil {
+		onHIDError(c, err)
 	}
 }
 
@@ -344,9 +553,71 @@ func onKeyboardEvent(c *KVMContext, wsReq WSRequest) {
 	var e KeyboardEvent
 	json.Unmarshal(wsReq.Payload, &e)
 
-	if c.Keyboard != nil {
-		c.Keyboard.Send(e.Code, e.AltKey, e.CtrlKey, e.MetaKey, e.ShiftKey)
+	if err := sendKeyboardEvent(c, wsReq.MessageType, e); err != nil {
+		onHIDError(c, err)
+	}
+}
+
+// onReleaseAllRequest releases all keys. The client sends it when the keyboard loses the focus.
+func onReleaseAllRequest(c *KVMContext, wsReq WSRequest) {
+	if err := releaseAllKeys(c); err != nil {
+		onHIDError(c, err)
+	}
+}
+
+func sendMouseEvent(c *KVMContext, e MouseEvent) error {
+	if c.Mouse == nil {
+		return nil
+	}
+
+	wakeupIfSuspended(c)
+	return c.Mouse.Send(e.Buttons, e.Pos.X, e.Pos.Y)
+}
+
+func sendMouseAbsEvent(c *KVMContext, e MouseAbsEvent) error {
+	if c.MouseAbs == nil {
+		return nil
 	}
+
+	wakeupIfSuspended(c)
+	return c.MouseAbs.Send(e.Buttons, int(e.Pos.X), int(e.Pos.Y))
+}
+
+func sendTouchEvent(c *KVMContext, e TouchEvent) error {
+	if c.TouchScreen == nil {
+		return nil
+	}
+
+	wakeupIfSuspended(c)
+	return c.TouchScreen.Send(e.Buttons, int(e.Pos.X), int(e.Pos.Y))
+}
+
+// sendKeyboardEvent presses (keyDown) or releases (keyUp) the key.
+func sendKeyboardEvent(c *KVMContext, messageType string, e KeyboardEvent) error {
+	if c.Keyboard == nil {
+		return nil
+	}
+
+	usage, ok := keymap.Usage(e.Code)
+	if !ok {
+		c.Echo.Logger().Warn("unknown key code: " + e.Code)
+		return nil
+	}
+
+	if messageType == "keyDown" {
+		wakeupIfSuspended(c)
+		return c.Keyboard.KeyDown(usage)
+	}
+
+	return c.Keyboard.KeyUp(usage)
+}
+
+func releaseAllKeys(c *KVMContext) error {
+	if c.Keyboard == nil || !c.Keyboard.IsPressed() {
+		return nil
+	}
+
+	return c.Keyboard.ReleaseAll()
 }
 
 func onGamepadEvent(c *KVMContext, wsReq WSRequest) {
@@ -354,7 +625,10 @@ func onGamepadEvent(c *KVMContext, wsReq WSRequest) {
 	json.Unmarshal(wsReq.Payload, &e)
 
 	if c.Gamepad != nil {
-		c.Gamepad.Send(e.Buttons, e.Axes)
+		err := c.Gamepad.Send(e.Buttons, e.Axes)
+		if err != nil {
+			onHIDError(c, err)
+		}
 	}
 }
 
@@ -383,15 +657,11 @@ func onWSClose(c *KVMContext) {
 		c.PC.Close()
 	}
 
-	if c.Usb != nil {
-		c.Mouse = nil
-		c.MouseAbs = nil
-		c.TouchScreen = nil
-		c.Keyboard = nil
-		c.Gamepad = nil
-
-		c.Usb.Stop()
+	if err := stopMacroRecording(c); err != nil {
+		c.Echo.Logger().Error(err)
 	}
+
+	stopUsb(c)
 }
 
 func wsHandler(ws *websocket.Conn, e echo.Context) {
@@ -402,6 +672,9 @@ func wsHandler(ws *websocket.Conn, e echo.Context) {
 	defer onWSClose(c)
 
 	for {
+		// the client sends keepAlive periodically, so keys are released if the client is gone silently
+		c.WS.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
 		var req WSRequest
 		err := websocket.JSON.Receive(c.WS, &req)
 		if err != nil {
@@ -413,17 +686,27 @@ func wsHandler(ws *websocket.Conn, e echo.Context) {
 			break
 		}
 
+		if c.Recorder != nil && !c.Recorder.Add(req) {
+			onMacroRecordLimit(c, req)
+		}
+
 		switch req.MessageType {
 		case "init":
 			onInitRequest(c, req)
+		case "setDevices":
+			onDevicesRequest(c, req)
+		case "videoSettings":
+			onVideoSettingsRequest(c, req)
 		case "mouseEvent":
 			onMouseEvent(c, req)
 		case "mouseAbsEvent":
 			onMouseAbsEvent(c, req)
 		case "touchEvent":
 			onTouchEvent(c, req)
-		case "keyEvent":
+		case "keyDown", "keyUp":
 			onKeyboardEvent(c, req)
+		case "releaseAll":
+			onReleaseAllRequest(c, req)
 		case "gamepadEvent":
 			onGamepadEvent(c, req)
 		case "answer":
@@ -432,6 +715,26 @@ func wsHandler(ws *websocket.Conn, e echo.Context) {
 			addIceCandidate(c, req)
 		case "runCommand":
 			runCommand(c, req)
+		case "wakeup":
+			onWakeupRequest(c, req)
+		case "typeText":
+			onTypeTextRequest(c, req)
+		case "typeTextCancel":
+			onTypeTextCancel(c, req)
+		case "sendPreset":
+			onPresetRequest(c, req)
+		case "presetCancel":
+			onPresetCancel(c, req)
+		case "macroRecordStart":
+			onMacroRecordStart(c, req)
+		case "macroRecordStop":
+			onMacroRecordStop(c, req)
+		case "macroList":
+			onMacroListRequest(c, req)
+		case "macroPlay":
+			onMacroPlayRequest(c, req)
+		case "macroCancel":
+			onMacroCancel(c, req)
 		case "keepAlive":
 			// NOP
 		default:
@@ -445,6 +748,26 @@ func wsEndpoint(c echo.Context) error {
 	return nil
 }
 
+func wakeupEndpoint(c echo.Context) error {
+	err := usbgadget.NewUSBGadget(usbGadgetName).Wakeup()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func hidStatsEndpoint(c echo.Context) error {
+	usbOwnerMutex.Lock()
+	defer usbOwnerMutex.Unlock()
+
+	if usbOwner == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "USB gadget is not enabled")
+	}
+
+	return c.JSON(http.StatusOK, usbOwner.Usb.Stats())
+}
+
 func loadConfig(filename string) error {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -452,7 +775,53 @@ func loadConfig(filename string) error {
 	}
 
 	err = yaml.Unmarshal(buf, &config)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if len(config.KeyboardLayout) == 0 {
+		config.KeyboardLayout = defaultKeyboardLayout
+	}
+	if len(config.MacroDir) == 0 {
+		config.MacroDir = defaultMacroDir
+	}
+	if len(config.ScriptDir) == 0 {
+		config.ScriptDir = defaultScriptDir
+	}
+	if len(config.MediaDir) == 0 {
+		config.MediaDir = defaultMediaDir
+	}
+	if len(config.ReferenceDir) == 0 {
+		config.ReferenceDir = defaultReferenceDir
+	}
+	if len(config.Timeline.Dir) == 0 {
+		config.Timeline.Dir = defaultTimelineDir
+	}
+	if config.Timeline.Width <= 0 {
+		config.Timeline.Width = defaultTimelineWidth
+	}
+	if config.Timeline.MaxFrames <= 0 {
+		config.Timeline.MaxFrames = defaultTimelineMaxFrames
+	}
+	if len(config.Recording.Dir) == 0 {
+		config.Recording.Dir = defaultRecordingDir
+	}
+	if len(config.Recording.Format) == 0 {
+		config.Recording.Format = defaultRecordingFormat
+	}
+	if _, ok := recordingMuxers[config.Recording.Format]; !ok {
+		return fmt.Errorf("unsupported recording format: %s", config.Recording.Format)
+	}
+	if config.Recording.Segment <= 0 {
+		config.Recording.Segment = defaultRecordingSegment
+	}
+
+	err = loadCaptureTemplate()
+	if err != nil {
+		return err
+	}
+
+	return loadPresets()
 }
 
 type Template struct {
@@ -477,10 +846,83 @@ func main() {
 	e := echo.New()
 	e.Renderer = t
 	e.Logger.SetLevel(log.INFO)
+	frames.Logger = e.Logger
+	if config.ScreenMonitorInterval > 0 {
+		go screenMonitor.Run(time.Duration(config.ScreenMonitorInterval) * time.Millisecond)
+	}
+	if config.Timeline.Interval > 0 {
+		timeline.Dir = config.Timeline.Dir
+		timeline.Width = config.Timeline.Width
+		timeline.MaxFrames = config.Timeline.MaxFrames
+		go timeline.Run(time.Duration(config.Timeline.Interval) * time.Second)
+	}
+	for _, encoder := range codecEncoders {
+		s := NewMediaStream(videoStreamName, encoder.MimeType)
+		s.Logger = e.Logger
+		s.SetEncoderBitrate = encoder.SetBitrate
+		if captureTemplate.InputFormat != testInputFormat {
+			s.Ready = captureDeviceReady
+		}
+		videoStreams[encoder.MimeType] = s
+		e.Logger.Infof("video encoder: %s (%s)", encoder.Name, encoder.MimeType)
+	}
+	videoRecorder.Dir = config.Recording.Dir
+	videoRecorder.Format = config.Recording.Format
+	videoRecorder.Always = config.Recording.Always
+	videoRecorder.Segment = time.Duration(config.Recording.Segment) * time.Minute
+	videoRecorder.MaxSize = int64(config.Recording.MaxSize) << 20
+	videoRecorder.Retention = time.Duration(config.Recording.RetentionDays) * 24 * time.Hour
+	videoRecorder.Logger = e.Logger
+	videoRecorder.RequestKeyframe = requestVideoKeyframe
+	audioStream.Logger = e.Logger
+	go videoRecorder.Run()
+	if captureTemplate.InputFormat != testInputFormat {
+		signalMonitor.Logger = e.Logger
+		go signalMonitor.Run(signalCheckInterval)
+	}
 	e.Use(middleware.Logger())
 	e.GET("/api/ws", wsEndpoint)
+	e.POST("/api/wakeup", wakeupEndpoint)
+	e.GET("/api/hid/stats", hidStatsEndpoint)
+	e.POST("/api/type", typeTextEndpoint)
+	e.DELETE("/api/type", typeTextCancelEndpoint)
+	e.GET("/api/presets", presetsEndpoint)
+	e.POST("/api/presets/:name", sendPresetEndpoint)
+	e.DELETE("/api/presets", cancelPresetEndpoint)
+	e.GET("/api/macros", macrosEndpoint)
+	e.GET("/api/macros/:name", macroEndpoint)
+	e.DELETE("/api/macros/:name", deleteMacroEndpoint)
+	e.POST("/api/macros/:name/play", playMacroEndpoint)
+	e.DELETE("/api/macros/:name/play", cancelMacroEndpoint)
+	e.GET("/api/scripts", scriptsEndpoint)
+	e.POST("/api/scripts/:name/run", runScriptEndpoint)
+	e.GET("/api/scripts/runs", scriptRunsEndpoint)
+	e.GET("/api/scripts/runs/:id", scriptRunEndpoint)
+	e.DELETE("/api/scripts/runs/:id", cancelScriptRunEndpoint)
+	e.GET("/api/encoders", encodersEndpoint)
+	e.GET("/api/capture/formats", captureFormatsEndpoint)
+	e.GET("/api/capture/signal", signalEndpoint)
+	e.GET("/api/streams", streamsEndpoint)
+	e.GET("/api/snapshot", snapshotEndpoint)
+	e.GET("/api/recording", recordingEndpoint)
+	e.POST("/api/recording", startRecordingEndpoint)
+	e.DELETE("/api/recording", stopRecordingEndpoint)
+	e.GET("/api/recordings", recordingsEndpoint)
+	e.GET("/api/recordings/:name", recordingFileEndpoint)
+	e.DELETE("/api/recordings/:name", deleteRecordingEndpoint)
+	e.GET("/api/timeline", timelineEndpoint)
+	e.GET("/api/timeline/at", timelineAtEndpoint)
+	e.GET("/api/timeline/:name", timelineImageEndpoint)
+	e.GET("/api/screen", screenStateEndpoint)
+	e.GET("/api/screen/match", screenMatchEndpoint)
+	e.GET("/api/screen/wait/match", screenWaitMatchEndpoint)
+	e.GET("/api/screen/wait/static", screenWaitStaticEndpoint)
+	e.GET("/api/screen/references", referencesEndpoint)
+	e.GET("/api/screen/references/:name", referenceEndpoint)
+	e.PUT("/api/screen/references/:name", putReferenceEndpoint)
+	e.DELETE("/api/screen/references/:name", deleteReferenceEndpoint)
 	e.GET("/", func(c echo.Context) error {
-		return c.Render(http.StatusOK, "kvm", config)
+		return c.Render(http.StatusOK, "kvm", TemplateData{Config: config, Layouts: keymap.Names(), Presets: presets})
 	})
 	e.Logger.Fatal(e.Start(config.ListenAddress))
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/keymap"
+	"github.com/msawahara/ipkvm/usbgadget"
+)
+
+const (
+	presetKeyDelay        = 50  // msec, between key events of a chord
+	defaultPresetInterval = 100 // msec, between chords
+)
+
+// builtinPresets are available without configuration. Presets in config.yaml with the same name override them.
+var builtinPresets = append([]ConfigPreset{
+	{Name: "Ctrl+Alt+Del", Keys: []string{"ControlLeft", "AltLeft", "Delete"}},
+	{Name: "Win+L", Keys: []string{"MetaLeft", "KeyL"}},
+	{Name: "Alt+SysRq REISUB", Interval: 2000, Sequence: [][]string{
+		{"AltLeft", "PrintScreen", "KeyR"},
+		{"AltLeft", "PrintScreen", "KeyE"},
+		{"AltLeft", "PrintScreen", "KeyI"},
+		{"AltLeft", "PrintScreen", "KeyS"},
+		{"AltLeft", "PrintScreen", "KeyU"},
+		{"AltLeft", "PrintScreen", "KeyB"},
+	}},
+}, append(ctrlAltFunctionKeys(), []ConfigPreset{
+	// for entering BIOS setup or boot menus
+	{Name: "Repeat Del", Keys: []string{"Delete"}, Interval: 200, Duration: 10000},
+	{Name: "Repeat F2", Keys: []string{"F2"}, Interval: 200, Duration: 10000},
+	{Name: "Repeat F12", Keys: []string{"F12"}, Interval: 200, Duration: 10000},
+	{Name: "Repeat Esc", Keys: []string{"Escape"}, Interval: 200, Duration: 10000},
+}...)...)
+
+// presets are built-in presets and presets in config.yaml, set by loadPresets.
+var presets []ConfigPreset
+
+type PresetRequest struct {
+	Name string `json:"name"`
+}
+
+type PresetResult struct {
+	Name      string `json:"name"`
+	Done      bool   `json:"done"`
+	Cancelled bool   `json:"cancelled"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ctrlAltFunctionKeys returns Ctrl+Alt+F1 .. Ctrl+Alt+F12 (switching virtual consoles).
+func ctrlAltFunctionKeys() []ConfigPreset {
+	p := []ConfigPreset{}
+	for i := 1; i <= 12; i++ {
+		key := fmt.Sprintf("F%d", i)
+		p = append(p, ConfigPreset{Name: "Ctrl+Alt+" + key, Keys: []string{"ControlLeft", "AltLeft", key}})
+	}
+
+	return p
+}
+
+// chords returns usage IDs of chords of the preset.
+func (p ConfigPreset) chords() ([][]int, error) {
+	sequence := p.Sequence
+	if len(sequence) == 0 {
+		sequence = [][]string{p.Keys}
+	}
+
+	chords := [][]int{}
+	for _, codes := range sequence {
+		if len(codes) == 0 {
+			return nil, fmt.Errorf("preset %s: empty chord", p.Name)
+		}
+
+		chord := []int{}
+		for _, code := range codes {
+			usage, ok := keymap.Usage(code)
+			if !ok {
+				return nil, fmt.Errorf("preset %s: unknown key code: %s", p.Name, code)
+			}
+			chord = append(chord, usage)
+		}
+		chords = append(chords, chord)
+	}
+
+	return chords, nil
+}
+
+func loadPresets() error {
+	presets = []ConfigPreset{}
+	index := map[string]int{}
+	for _, p := range append(builtinPresets, config.Presets...) {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("preset without name")
+		}
+		if _, err := p.chords(); err != nil {
+			return err
+		}
+
+		if i, ok := index[p.Name]; ok {
+			presets[i] = p
+			continue
+		}
+		index[p.Name] = len(presets)
+		presets = append(presets, p)
+	}
+
+	return nil
+}
+
+func findPreset(name string) (ConfigPreset, bool) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return ConfigPreset{}, false
+}
+
+// sendPreset sends chords of the preset. If the duration is set, chords are repeated until the duration has elapsed.
+func sendPreset(k *usbgadget.USBGadgetKeyboard, p ConfigPreset, j *TypeJob) PresetResult {
+	r := PresetResult{Name: p.Name}
+
+	chords, err := p.chords()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	interval := time.Duration(p.Interval) * time.Millisecond
+	if p.Interval <= 0 {
+		interval = defaultPresetInterval * time.Millisecond
+	}
+	end := time.Now().Add(time.Duration(p.Duration) * time.Millisecond)
+
+	for {
+		for i, chord := range chords {
+			err := pressKeys(k, chord, presetKeyDelay*time.Millisecond)
+			if err != nil {
+				r.Error = err.Error()
+				return r
+			}
+
+			if i == len(chords)-1 && !time.Now().Add(interval).Before(end) {
+				r.Done = true
+				return r
+			}
+
+			select {
+			case <-j.cancel:
+				r.Cancelled = true
+				return r
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+func onPresetRequest(c *KVMContext, wsReq WSRequest) {
+	var r PresetRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	if c.Keyboard == nil {
+		sendError(c.WS, "keyboard is not enabled")
+		return
+	}
+
+	p, ok := findPreset(r.Name)
+	if !ok {
+		sendError(c.WS, "unknown preset: "+r.Name)
+		return
+	}
+
+	j, err := startTypeJob(typeJobPreset, p.Name)
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	wakeupIfSuspended(c)
+
+	k := c.Keyboard
+	go func() {
+		defer finishTypeJob(j)
+
+		result := sendPreset(k, p, j)
+		sendMessage(c.WS, "presetResult", result)
+		c.Echo.Logger().Infof("send preset: %+v", result)
+	}()
+}
+
+func onPresetCancel(c *KVMContext, wsReq WSRequest) {
+	cancelTypeJob(typeJobPreset, "")
+}
+
+func presetsEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, presets)
+}
+
+func cancelPresetEndpoint(c echo.Context) error {
+	if !cancelTypeJob(typeJobPreset, "") {
+		return echo.NewHTTPError(http.StatusNotFound, "preset is not in progress")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func sendPresetEndpoint(c echo.Context) error {
+	p, ok := findPreset(c.Param("name"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown preset: "+c.Param("name"))
+	}
+
+	k := ownerKeyboard()
+	if k == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "keyboard is not enabled")
+	}
+
+	j, err := startTypeJob(typeJobPreset, p.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	defer finishTypeJob(j)
+
+	// cancel if the client has gone
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			j.Cancel()
+		case <-done:
+		}
+	}()
+
+	result := sendPreset(k, p, j)
+
+	return c.JSON(http.StatusOK, result)
+}
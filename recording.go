@@ -0,0 +1,515 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/notedit/gst"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	defaultRecordingDir     = "recordings"
+	defaultRecordingFormat  = "mkv"
+	defaultRecordingSegment = 30 // min
+	recordingTimeFormat     = "20060102T150405.000Z"
+	recordingFinishTimeout  = 5 * time.Second
+	recordingCleanupPeriod  = time.Minute
+)
+
+// recordingMuxers are sinks of recording pipelines by format, %s is the path of the file.
+// fragmented MP4 can be played even if the file is not finalized.
+var recordingMuxers = map[string]string{
+	"mkv": "matroskamux name=mux ! filesink location=\"%s\"",
+	"mp4": "mp4mux name=mux fragment-duration=1000 ! filesink location=\"%s\"",
+}
+
+// recordingCodecs are video codecs supported by formats, all codecs are supported if a format is not listed.
+// Unsupported codecs are recorded in the default format.
+var recordingCodecs = map[string][]string{
+	"mp4": {webrtc.MimeTypeH264, webrtc.MimeTypeVP9, webrtc.MimeTypeAV1},
+}
+
+// recordingFormat returns the format of files for the codec.
+func recordingFormat(format, mimeType string) string {
+	codecs, ok := recordingCodecs[format]
+	if !ok {
+		return format
+	}
+	for _, codec := range codecs {
+		if strings.EqualFold(codec, mimeType) {
+			return format
+		}
+	}
+
+	return defaultRecordingFormat
+}
+
+// recordingSources receive encoded samples of the streams, %s are caps and parser of the video codec.
+const recordingSources = " appsrc name=video is-live=true do-timestamp=true format=time caps=%s%s ! queue ! mux." +
+	" appsrc name=audio is-live=true do-timestamp=true format=time caps=audio/x-opus,rate=48000,channels=2,channel-mapping-family=0" +
+	" ! opusparse ! queue ! mux."
+
+// VideoRecorder records video and audio streams into files.
+// Files are rotated every Segment on a keyframe.
+type VideoRecorder struct {
+	Dir    string
+	Format string
+	// codec of the video stream
+	MimeType string
+	// record while video is streamed without starting recording
+	Always  bool
+	Segment time.Duration
+	// 0 is unlimited
+	MaxSize   int64
+	Retention time.Duration
+	Logger    echo.Logger
+	// RequestKeyframe asks the encoder to emit a keyframe to start a file promptly
+	RequestKeyframe func()
+
+	mutex   sync.Mutex
+	enabled bool
+	current *recordingFile
+	// the last time when a keyframe is requested
+	keyframeRequested time.Time
+	// SPS and PPS of the stream, inserted at the beginning of a file
+	parameterSets []byte
+	// names of closed files which are being finalized
+	finishing map[string]bool
+}
+
+type recordingFile struct {
+	name     string
+	started  time.Time
+	pipeline *gst.Pipeline
+	video    *gst.Element
+	audio    *gst.Element
+}
+
+// RecordingStatus is the status of the recorder.
+type RecordingStatus struct {
+	Recording bool   `json:"recording"`
+	Always    bool   `json:"always"`
+	File      string `json:"file,omitempty"`
+}
+
+// RecordingInfo is a recorded file.
+type RecordingInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Recording bool      `json:"recording"` // being recorded or finalized
+}
+
+var videoRecorder = &VideoRecorder{}
+
+func (r *VideoRecorder) Status() RecordingStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := RecordingStatus{Recording: r.active(), Always: r.Always}
+	if r.current != nil {
+		status.File = r.current.name
+	}
+
+	return status
+}
+
+// Start starts recording of sessions.
+func (r *VideoRecorder) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.enabled = true
+}
+
+// Stop stops recording. Always recording is not stopped.
+func (r *VideoRecorder) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.enabled = false
+	if !r.Always {
+		r.closeFile()
+	}
+}
+
+// active must be called with the lock.
+func (r *VideoRecorder) active() bool {
+	return r.enabled || r.Always
+}
+
+// Write records an encoded sample (kind is "video" or "audio") of the streams.
+func (r *VideoRecorder) Write(kind string, data []byte) {
+	// the stream is locked while requesting a keyframe, it must not be called with the lock of the recorder
+	if r.write(kind, data) && r.RequestKeyframe != nil {
+		r.RequestKeyframe()
+	}
+}
+
+// write returns true if a keyframe should be requested.
+func (r *VideoRecorder) write(kind string, data []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.active() {
+		return false
+	}
+
+	needKeyframe := false
+	if kind == "video" {
+		data, needKeyframe = r.checkKeyframe(data)
+	}
+	if r.current == nil {
+		// waiting for a keyframe
+		return needKeyframe
+	}
+
+	element := r.current.audio
+	if kind == "video" {
+		element = r.current.video
+	}
+	err := element.PushBuffer(data)
+	if err != nil {
+		r.Logger.Debugf("recording: %s", err)
+	}
+
+	return needKeyframe
+}
+
+// SetMimeType changes the codec of the video stream. The file is closed if the codec is changed.
+func (r *VideoRecorder) SetMimeType(mimeType string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if strings.EqualFold(r.MimeType, mimeType) {
+		return
+	}
+
+	r.closeFile()
+	r.MimeType = mimeType
+	r.parameterSets = nil
+
+	if format := recordingFormat(r.Format, mimeType); format != r.Format {
+		r.Logger.Warnf("recording: %s is not supported by %s, recorded in %s", mimeType, r.Format, format)
+	}
+}
+
+// checkKeyframe opens or rotates the file on a keyframe.
+// The returned sample has parameter sets if it is the first frame of the file,
+// and true is returned if a keyframe is needed to open or rotate the file.
+// It must be called with the lock.
+func (r *VideoRecorder) checkKeyframe(data []byte) ([]byte, bool) {
+	keyframe := false
+	// parameter sets of codecs other than H.264 are in keyframes
+	hasParameterSets := true
+	if r.MimeType == webrtc.MimeTypeH264 {
+		hasParameterSets = false
+		parameterSets := []byte{}
+		for _, unit := range h264NALUnits(data) {
+			switch h264NALType(unit) {
+			case h264NALTypeIDR:
+				keyframe = true
+			case h264NALTypeSPS, h264NALTypePPS:
+				hasParameterSets = true
+				parameterSets = append(parameterSets, unit...)
+			}
+		}
+		if hasParameterSets {
+			r.parameterSets = parameterSets
+		}
+	} else if codec, ok := videoCodecs[r.MimeType]; ok {
+		keyframe = codec.IsKeyframe(data)
+	}
+
+	if r.current != nil && time.Since(r.current.started) < r.Segment {
+		return data, false
+	}
+	if !keyframe || (r.MimeType == webrtc.MimeTypeH264 && len(r.parameterSets) == 0) {
+		return data, r.keyframeRequestable()
+	}
+
+	r.closeFile()
+	err := r.openFile()
+	if err != nil {
+		r.Logger.Errorf("recording: %s", err)
+		return data, false
+	}
+
+	if !hasParameterSets {
+		data = append(append([]byte{}, r.parameterSets...), data...)
+	}
+
+	return data, false
+}
+
+// keyframeRequestable limits keyframe requests to once a second. It must be called with the lock.
+func (r *VideoRecorder) keyframeRequestable() bool {
+	if time.Since(r.keyframeRequested) < time.Second {
+		return false
+	}
+
+	r.keyframeRequested = time.Now()
+	return true
+}
+
+// openFile must be called with the lock.
+func (r *VideoRecorder) openFile() error {
+	format := recordingFormat(r.Format, r.MimeType)
+	muxer, ok := recordingMuxers[format]
+	if !ok {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	codec, ok := videoCodecs[r.MimeType]
+	if !ok {
+		return fmt.Errorf("unsupported codec: %s", r.MimeType)
+	}
+	parser := ""
+	if len(codec.Parser) > 0 {
+		parser = " ! " + codec.Parser
+	}
+
+	err := os.MkdirAll(r.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// filesink truncates an existing file (e.g. the previous file which is being finalized)
+	now := time.Now().UTC()
+	name := ""
+	for {
+		name = now.Format(recordingTimeFormat) + "." + format
+		if _, err := os.Stat(filepath.Join(r.Dir, name)); err != nil && !r.finishing[name] {
+			break
+		}
+		now = now.Add(time.Millisecond)
+	}
+	pipeline, err := gst.ParseLaunch(fmt.Sprintf(muxer, filepath.Join(r.Dir, name)) + fmt.Sprintf(recordingSources, codec.Caps, parser))
+	if err != nil {
+		return err
+	}
+	pipeline.SetState(gst.StatePlaying)
+
+	r.current = &recordingFile{
+		name:     name,
+		started:  now,
+		pipeline: pipeline,
+		video:    pipeline.GetByName("video"),
+		audio:    pipeline.GetByName("audio"),
+	}
+	r.Logger.Infof("recording started (file: %s)", name)
+
+	return nil
+}
+
+// closeFile must be called with the lock.
+func (r *VideoRecorder) closeFile() {
+	if r.current == nil {
+		return
+	}
+
+	f := r.current
+	r.current = nil
+	if r.finishing == nil {
+		r.finishing = map[string]bool{}
+	}
+	r.finishing[f.name] = true
+
+	go func() {
+		f.finish(r.Logger)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.finishing, f.name)
+	}()
+}
+
+// inUse returns true if the file is being recorded or finalized.
+func (r *VideoRecorder) inUse(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return (r.current != nil && r.current.name == name) || r.finishing[name]
+}
+
+// finish finalizes the file after the muxer receives EOS.
+func (f *recordingFile) finish(logger echo.Logger) {
+	defer f.pipeline.SetState(gst.StateNull)
+
+	f.pipeline.SendEvent(gst.NewEosEvent())
+
+	bus := f.pipeline.GetBus()
+	deadline := time.Now().Add(recordingFinishTimeout)
+	for time.Now().Before(deadline) {
+		for bus.HavePending() {
+			m := bus.Pop()
+			if m.C == nil {
+				break
+			}
+			switch m.GetType() {
+			case gst.MessageEos:
+				logger.Infof("recording finished (file: %s)", f.name)
+				return
+			case gst.MessageError:
+				logger.Errorf("recording error (file: %s): %s", f.name, errorMessage(m))
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	logger.Warnf("recording is not finalized (file: %s)", f.name)
+}
+
+// Close closes the file when the stream stops. The stream is recorded to a new file when it is restarted.
+func (r *VideoRecorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closeFile()
+	r.parameterSets = nil
+}
+
+// List returns recorded files from the oldest.
+func (r *VideoRecorder) List() ([]RecordingInfo, error) {
+	files, err := ioutil.ReadDir(r.Dir)
+	if os.IsNotExist(err) {
+		return []RecordingInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []RecordingInfo{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if _, ok := recordingMuxers[strings.TrimPrefix(filepath.Ext(file.Name()), ".")]; !ok {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{
+			Name:      file.Name(),
+			Size:      file.Size(),
+			Modified:  file.ModTime(),
+			Recording: r.inUse(file.Name()),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Name < recordings[j].Name })
+
+	return recordings, nil
+}
+
+// Cleanup removes files older than Retention, and the oldest files while the total size exceeds MaxSize.
+func (r *VideoRecorder) Cleanup() error {
+	recordings, err := r.List()
+	if err != nil {
+		return err
+	}
+
+	total := int64(0)
+	for _, rec := range recordings {
+		total += rec.Size
+	}
+
+	for _, rec := range recordings {
+		expired := r.Retention > 0 && time.Since(rec.Modified) > r.Retention
+		exceeded := r.MaxSize > 0 && total > r.MaxSize
+		if rec.Recording || !(expired || exceeded) {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(r.Dir, rec.Name))
+		if err != nil {
+			return err
+		}
+		total -= rec.Size
+		r.Logger.Infof("recording removed (file: %s)", rec.Name)
+	}
+
+	return nil
+}
+
+// Run removes old files periodically.
+func (r *VideoRecorder) Run() {
+	ticker := time.NewTicker(recordingCleanupPeriod)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		err := r.Cleanup()
+		if err != nil {
+			r.Logger.Errorf("recording: %s", err)
+		}
+	}
+}
+
+func recordingPath(name string) (string, error) {
+	if filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return "", errors.New("invalid name: " + name)
+	}
+
+	return filepath.Join(videoRecorder.Dir, name), nil
+}
+
+func recordingEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, videoRecorder.Status())
+}
+
+func startRecordingEndpoint(c echo.Context) error {
+	videoRecorder.Start()
+	return c.JSON(http.StatusOK, videoRecorder.Status())
+}
+
+func stopRecordingEndpoint(c echo.Context) error {
+	videoRecorder.Stop()
+	return c.JSON(http.StatusOK, videoRecorder.Status())
+}
+
+func recordingsEndpoint(c echo.Context) error {
+	recordings, err := videoRecorder.List()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, recordings)
+}
+
+func recordingFileEndpoint(c echo.Context) error {
+	name := c.Param("name")
+	path, err := recordingPath(name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.Attachment(path, name)
+}
+
+func deleteRecordingEndpoint(c echo.Context) error {
+	name := c.Param("name")
+	path, err := recordingPath(name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if videoRecorder.inUse(name) {
+		return echo.NewHTTPError(http.StatusConflict, "file is being recorded: "+name)
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusNotFound, "recording is not found: "+name)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+)
+
+// scale modes fit the captured frame into the encoded video, whose size is a multiple of 16 except native
+const (
+	// add black borders to the right and bottom
+	scaleModePad = "pad"
+	// scale down keeping the aspect ratio, and add black borders around
+	scaleModeFit = "fit"
+	// crop the center
+	scaleModeCrop = "crop"
+	// encode the captured size as is (for software encoders)
+	scaleModeNative = "native"
+
+	defaultScaleMode = scaleModeFit
+	videoBlockSize   = 16
+)
+
+// Rect is an area in pixels.
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// VideoLayout is the placement of the captured frame in the encoded video.
+type VideoLayout struct {
+	Mode string `json:"mode"`
+	// size of the encoded video
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// active picture area in the encoded video
+	Picture Rect `json:"picture"`
+	// area of the captured frame shown in the picture
+	Source Rect `json:"source"`
+	// size of the captured frame
+	SourceWidth  int `json:"sourceWidth"`
+	SourceHeight int `json:"sourceHeight"`
+}
+
+func alignUp(n int) int {
+	return (n + videoBlockSize - 1) / videoBlockSize * videoBlockSize
+}
+
+func alignDown(n int) int {
+	return n / videoBlockSize * videoBlockSize
+}
+
+// videoLayout returns the layout of the captured frame (width x height) in the scale mode.
+// Offsets are even not to shift chroma of subsampled formats.
+func videoLayout(mode string, width, height int) (VideoLayout, error) {
+	if len(mode) == 0 {
+		mode = defaultScaleMode
+	}
+
+	l := VideoLayout{
+		Mode:         mode,
+		Width:        width,
+		Height:       height,
+		Picture:      Rect{Width: width, Height: height},
+		Source:       Rect{Width: width, Height: height},
+		SourceWidth:  width,
+		SourceHeight: height,
+	}
+
+	switch mode {
+	case scaleModePad:
+		l.Width, l.Height = alignUp(width), alignUp(height)
+	case scaleModeFit:
+		l.Width, l.Height = alignDown(width), alignDown(height)
+		zoom := float64(l.Width) / float64(width)
+		if z := float64(l.Height) / float64(height); z < zoom {
+			zoom = z
+		}
+		l.Picture.Width = int(float64(width)*zoom) &^ 1
+		l.Picture.Height = int(float64(height)*zoom) &^ 1
+		l.Picture.X = (l.Width - l.Picture.Width) / 2 &^ 1
+		l.Picture.Y = (l.Height - l.Picture.Height) / 2 &^ 1
+	case scaleModeCrop:
+		l.Width, l.Height = alignDown(width), alignDown(height)
+		l.Picture = Rect{Width: l.Width, Height: l.Height}
+		l.Source = Rect{X: (width - l.Width) / 2 &^ 1, Y: (height - l.Height) / 2 &^ 1, Width: l.Width, Height: l.Height}
+	case scaleModeNative:
+	default:
+		return l, fmt.Errorf("invalid scale mode: %s", mode)
+	}
+
+	return l, nil
+}
+
+// elements returns elements which convert the captured frame into the encoded video, empty if no conversion is needed.
+func (l VideoLayout) elements() string {
+	elements := ""
+	add := func(format string, a ...interface{}) {
+		if len(elements) > 0 {
+			elements += " ! "
+		}
+		elements += fmt.Sprintf(format, a...)
+	}
+
+	// crop (positive values) the source
+	left, top := l.Source.X, l.Source.Y
+	right, bottom := l.SourceWidth-left-l.Source.Width, l.SourceHeight-top-l.Source.Height
+	if left != 0 || top != 0 || right != 0 || bottom != 0 {
+		add("videobox left=%d right=%d top=%d bottom=%d", left, right, top, bottom)
+	}
+
+	if l.Picture.Width != l.Source.Width || l.Picture.Height != l.Source.Height {
+		add("videoscale ! video/x-raw,width=%d,height=%d,pixel-aspect-ratio=1/1", l.Picture.Width, l.Picture.Height)
+	}
+
+	// add borders (negative values) around the picture
+	left, top = l.Picture.X, l.Picture.Y
+	right, bottom = l.Width-left-l.Picture.Width, l.Height-top-l.Picture.Height
+	if left != 0 || top != 0 || right != 0 || bottom != 0 {
+		add("videobox left=%d right=%d top=%d bottom=%d", -left, -right, -top, -bottom)
+	}
+
+	return elements
+}
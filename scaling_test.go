@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVideoLayout(t *testing.T) {
+	tests := []struct {
+		mode          string
+		width, height int
+		want          VideoLayout
+	}{
+		{
+			scaleModePad, 1920, 1080,
+			VideoLayout{Mode: scaleModePad, Width: 1920, Height: 1088,
+				Picture: Rect{0, 0, 1920, 1080}, Source: Rect{0, 0, 1920, 1080}, SourceWidth: 1920, SourceHeight: 1080},
+		},
+		{
+			"", 1920, 1080,
+			VideoLayout{Mode: scaleModeFit, Width: 1920, Height: 1072,
+				Picture: Rect{8, 0, 1904, 1072}, Source: Rect{0, 0, 1920, 1080}, SourceWidth: 1920, SourceHeight: 1080},
+		},
+		{
+			scaleModePad, 800, 600,
+			VideoLayout{Mode: scaleModePad, Width: 800, Height: 608,
+				Picture: Rect{0, 0, 800, 600}, Source: Rect{0, 0, 800, 600}, SourceWidth: 800, SourceHeight: 600},
+		},
+		{
+			scaleModeFit, 1920, 1080,
+			VideoLayout{Mode: scaleModeFit, Width: 1920, Height: 1072,
+				Picture: Rect{8, 0, 1904, 1072}, Source: Rect{0, 0, 1920, 1080}, SourceWidth: 1920, SourceHeight: 1080},
+		},
+		{
+			scaleModeFit, 800, 600,
+			VideoLayout{Mode: scaleModeFit, Width: 800, Height: 592,
+				Picture: Rect{6, 0, 788, 592}, Source: Rect{0, 0, 800, 600}, SourceWidth: 800, SourceHeight: 600},
+		},
+		{
+			scaleModeCrop, 1920, 1080,
+			VideoLayout{Mode: scaleModeCrop, Width: 1920, Height: 1072,
+				Picture: Rect{0, 0, 1920, 1072}, Source: Rect{0, 4, 1920, 1072}, SourceWidth: 1920, SourceHeight: 1080},
+		},
+		{
+			// offsets are rounded down to even
+			scaleModeCrop, 1366, 770,
+			VideoLayout{Mode: scaleModeCrop, Width: 1360, Height: 768,
+				Picture: Rect{0, 0, 1360, 768}, Source: Rect{2, 0, 1360, 768}, SourceWidth: 1366, SourceHeight: 770},
+		},
+		{
+			scaleModeNative, 1366, 768,
+			VideoLayout{Mode: scaleModeNative, Width: 1366, Height: 768,
+				Picture: Rect{0, 0, 1366, 768}, Source: Rect{0, 0, 1366, 768}, SourceWidth: 1366, SourceHeight: 768},
+		},
+	}
+
+	for _, tt := range tests {
+		l, err := videoLayout(tt.mode, tt.width, tt.height)
+		if err != nil {
+			t.Errorf("videoLayout(%q, %d, %d): %v", tt.mode, tt.width, tt.height, err)
+			continue
+		}
+		if l != tt.want {
+			t.Errorf("videoLayout(%q, %d, %d) = %+v, want %+v", tt.mode, tt.width, tt.height, l, tt.want)
+		}
+		if l.Mode != scaleModeNative && (l.Width%videoBlockSize != 0 || l.Height%videoBlockSize != 0) {
+			t.Errorf("videoLayout(%q, %d, %d): %dx%d is not aligned", tt.mode, tt.width, tt.height, l.Width, l.Height)
+		}
+	}
+
+	if _, err := videoLayout("stretch", 1920, 1080); err == nil {
+		t.Error("videoLayout(\"stretch\") is not an error")
+	}
+}
+
+func TestVideoLayoutElements(t *testing.T) {
+	tests := []struct {
+		mode          string
+		width, height int
+		want          string
+	}{
+		{scaleModePad, 1920, 1080, "videobox left=0 right=0 top=0 bottom=-8"},
+		{scaleModePad, 1280, 720, ""},
+		{scaleModeFit, 1920, 1080, "videoscale ! video/x-raw,width=1904,height=1072,pixel-aspect-ratio=1/1 ! videobox left=-8 right=-8 top=0 bottom=0"},
+		{scaleModeFit, 800, 600, "videoscale ! video/x-raw,width=788,height=592,pixel-aspect-ratio=1/1 ! videobox left=-6 right=-6 top=0 bottom=0"},
+		{scaleModeCrop, 1920, 1080, "videobox left=0 right=0 top=4 bottom=4"},
+		{scaleModeCrop, 1366, 770, "videobox left=2 right=4 top=0 bottom=2"},
+		{scaleModeNative, 1366, 768, ""},
+	}
+
+	for _, tt := range tests {
+		l, err := videoLayout(tt.mode, tt.width, tt.height)
+		if err != nil {
+			t.Errorf("videoLayout(%q, %d, %d): %v", tt.mode, tt.width, tt.height, err)
+			continue
+		}
+		if got := l.elements(); got != tt.want {
+			t.Errorf("%s %dx%d: elements() = %q, want %q", tt.mode, tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestVideoRequestScaleMode(t *testing.T) {
+	hardware := VideoEncoder{Name: "v4l2h264enc", Hardware: true}
+	software := VideoEncoder{Name: "x264enc"}
+
+	tests := []struct {
+		mode    string
+		e       VideoEncoder
+		wantErr bool
+	}{
+		{"", hardware, false},
+		{scaleModePad, hardware, false},
+		{scaleModeNative, hardware, true},
+		{scaleModeNative, software, false},
+	}
+
+	for _, tt := range tests {
+		v := VideoRequest{Width: 1920, Height: 1080, Framerate: 30, TargetBitrate: 2500, ScaleMode: tt.mode}
+		if err := v.validate(tt.e); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%q, %s) = %v, want error: %v", tt.mode, tt.e.Name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package screen
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+/* thresholds of luma statistics */
+const (
+	BLACK_LEVEL   float64 = 0.06 // mean luma of a black screen
+	UNIFORM_LEVEL float64 = 0.02 // standard deviation of luma of a blank screen (e.g. "no signal" of capture devices)
+)
+
+// Stats are statistics of luma in the region, in [0, 1].
+type Stats struct {
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stdDev"`
+}
+
+// IsBlank returns true if the region is filled with a color.
+func (s Stats) IsBlank() bool {
+	return s.StdDev < UNIFORM_LEVEL
+}
+
+// IsBlack returns true if the region is blank and dark.
+func (s Stats) IsBlack() bool {
+	return s.IsBlank() && s.Mean < BLACK_LEVEL
+}
+
+// Luma returns statistics of luma of pixels in the region.
+func Luma(img image.Image, r image.Rectangle) Stats {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return Stats{}
+	}
+
+	var sum, sumSq float64
+	add := func(v float64) {
+		sum += v
+		sumSq += v * v
+	}
+
+	if ycc, ok := img.(*image.YCbCr); ok {
+		// decoded JPEG frames have Y plane
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				add(float64(ycc.Y[ycc.YOffset(x, y)]) / 0xff)
+			}
+		}
+	} else {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				cr, cg, cb, _ := img.At(x, y).RGBA()
+				// ITU-R BT.601
+				add((0.299*float64(cr) + 0.587*float64(cg) + 0.114*float64(cb)) / 0xffff)
+			}
+		}
+	}
+
+	n := float64(r.Dx() * r.Dy())
+	mean := sum / n
+
+	return Stats{Mean: mean, StdDev: math.Sqrt(math.Max(0, sumSq/n-mean*mean))}
+}
+
+// ChangeDetector detects that frames stop changing.
+type ChangeDetector struct {
+	Tolerance float64         // maximum difference of static frames (see Difference)
+	Region    image.Rectangle // compared region, whole frame if empty
+
+	base    image.Image
+	changed time.Time
+}
+
+// Update compares the frame with the frame at the last change.
+// It returns the time of the last change.
+func (d *ChangeDetector) Update(img image.Image, t time.Time) time.Time {
+	r := d.Region
+	if r.Empty() {
+		r = img.Bounds()
+	}
+
+	if d.base == nil || !d.base.Bounds().Eq(img.Bounds()) || Difference(d.base, img, r) > d.Tolerance {
+		d.base = img
+		d.changed = t
+	}
+
+	return d.changed
+}
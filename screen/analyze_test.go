@@ -0,0 +1,95 @@
+package screen
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestLuma(t *testing.T) {
+	checker := filled(4, 4, black)
+	for y := 0; y < 4; y++ {
+		for x := (y % 2); x < 4; x += 2 {
+			checker.Set(x, y, white)
+		}
+	}
+	halfWhite := filled(4, 4, black)
+	fill(halfWhite, image.Rect(2, 0, 4, 4), white)
+
+	ycc := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+	for i := range ycc.Y {
+		ycc.Y[i] = 0x08
+	}
+	for i := range ycc.Cb {
+		ycc.Cb[i] = 0x80
+		ycc.Cr[i] = 0x80
+	}
+
+	tests := []struct {
+		name  string
+		img   image.Image
+		r     image.Rectangle
+		mean  float64
+		blank bool
+		black bool
+	}{
+		{"black", filled(4, 4, black), image.Rect(0, 0, 4, 4), 0, true, true},
+		{"white", filled(4, 4, white), image.Rect(0, 0, 4, 4), 1, true, false},
+		{"gray", filled(4, 4, gray), image.Rect(0, 0, 4, 4), float64(0x80) / 0xff, true, false},
+		{"dark", filled(4, 4, color.RGBA{0x08, 0x08, 0x08, 0xff}), image.Rect(0, 0, 4, 4), float64(0x08) / 0xff, true, true},
+		{"checker", checker, image.Rect(0, 0, 4, 4), 0.5, false, false},
+		{"black region", halfWhite, image.Rect(0, 0, 2, 4), 0, true, true},
+		{"mixed region", halfWhite, image.Rect(1, 0, 3, 4), 0.5, false, false},
+		{"YCbCr", ycc, image.Rect(0, 0, 4, 4), float64(0x08) / 0xff, true, true},
+		{"empty region", filled(4, 4, white), image.Rect(8, 8, 9, 9), 0, true, true},
+	}
+
+	for _, tt := range tests {
+		s := Luma(tt.img, tt.r)
+		if !almostEqual(s.Mean, tt.mean) || s.IsBlank() != tt.blank || s.IsBlack() != tt.black {
+			t.Errorf("%s: Luma() = %+v (blank %t, black %t), want mean %.4f (blank %t, black %t)",
+				tt.name, s, s.IsBlank(), s.IsBlack(), tt.mean, tt.blank, tt.black)
+		}
+	}
+}
+
+func TestChangeDetector(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	// a pixel changes slightly
+	noisy := filled(4, 4, black)
+	noisy.Set(0, 0, color.RGBA{0x10, 0x10, 0x10, 0xff})
+	// the change is out of the region
+	outside := filled(4, 4, black)
+	fill(outside, image.Rect(2, 0, 4, 4), white)
+
+	frames := []struct {
+		img     image.Image
+		changed time.Time
+	}{
+		{filled(4, 4, black), at(0)},
+		{filled(4, 4, black), at(0)},
+		{noisy, at(0)},
+		{outside, at(0)},
+		{filled(4, 4, white), at(4)},
+		{filled(4, 4, white), at(4)},
+		// resolution change
+		{filled(8, 8, white), at(6)},
+	}
+
+	d := ChangeDetector{Tolerance: 0.01, Region: image.Rect(0, 0, 2, 4)}
+	for i, f := range frames {
+		if got := d.Update(f.img, at(i)); !got.Equal(f.changed) {
+			t.Errorf("frame %d: Update() = %v, want %v", i, got.Sub(start), f.changed.Sub(start))
+		}
+	}
+
+	// the whole frame is compared without the region
+	d = ChangeDetector{Tolerance: 0.01}
+	d.Update(filled(4, 4, black), at(0))
+	if got := d.Update(outside, at(1)); !got.Equal(at(1)) {
+		t.Errorf("whole frame: Update() = %v, want %v", got.Sub(start), at(1).Sub(start))
+	}
+}
@@ -0,0 +1,58 @@
+// Package screen provides helpers to analyze captured frames of the target screen.
+package screen
+
+import (
+	"image"
+	"image/color"
+)
+
+// Difference returns the mean absolute difference of pixels of two images in the region.
+// The result is 0 for identical regions and 1 for black against white.
+func Difference(a, b image.Image, r image.Rectangle) float64 {
+	r = r.Intersect(a.Bounds()).Intersect(b.Bounds())
+	if r.Empty() {
+		return 1
+	}
+
+	return difference(a, b, r, r.Min)
+}
+
+// MatchAt compares the reference image with the region of the frame at the point.
+// It returns the mean absolute difference as Difference. The reference must be within the frame.
+func MatchAt(frame, ref image.Image, at image.Point) float64 {
+	rb := ref.Bounds()
+	r := rb.Sub(rb.Min).Add(at)
+	if !r.In(frame.Bounds()) {
+		return 1
+	}
+
+	return difference(frame, ref, r, rb.Min)
+}
+
+// difference compares region r of a with region of b starting at bMin.
+func difference(a, b image.Image, r image.Rectangle, bMin image.Point) float64 {
+	var sum uint64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := b.At(bMin.X+x-r.Min.X, bMin.Y+y-r.Min.Y)
+			sum += colorDistance(a.At(x, y), p)
+		}
+	}
+
+	return float64(sum) / float64(r.Dx()*r.Dy()) / (3 * 0xffff)
+}
+
+func colorDistance(a, b color.Color) uint64 {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+
+	return absDiff(ar, br) + absDiff(ag, bg) + absDiff(ab, bb)
+}
+
+func absDiff(a, b uint32) uint64 {
+	if a > b {
+		return uint64(a - b)
+	}
+
+	return uint64(b - a)
+}
@@ -0,0 +1,103 @@
+package screen
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+var (
+	black = color.RGBA{0, 0, 0, 0xff}
+	white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	gray  = color.RGBA{0x80, 0x80, 0x80, 0xff}
+)
+
+// filled returns an image of the size filled with the color.
+func filled(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	fill(img, img.Bounds(), c)
+
+	return img
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.Color) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-3
+}
+
+func TestDifference(t *testing.T) {
+	halfWhite := filled(4, 4, black)
+	fill(halfWhite, image.Rect(2, 0, 4, 4), white)
+	noisy := filled(4, 4, black)
+	noisy.Set(0, 0, color.RGBA{0x40, 0x40, 0x40, 0xff})
+
+	tests := []struct {
+		name string
+		a, b image.Image
+		r    image.Rectangle
+		want float64
+	}{
+		{"identical", filled(4, 4, gray), filled(4, 4, gray), image.Rect(0, 0, 4, 4), 0},
+		{"black and white", filled(4, 4, black), filled(4, 4, white), image.Rect(0, 0, 4, 4), 1},
+		{"half", filled(4, 4, black), halfWhite, image.Rect(0, 0, 4, 4), 0.5},
+		{"same region", filled(4, 4, black), halfWhite, image.Rect(0, 0, 2, 4), 0},
+		{"different region", filled(4, 4, black), halfWhite, image.Rect(2, 0, 4, 4), 1},
+		// a pixel of 1/4 brightness in 16 pixels
+		{"noise", filled(4, 4, black), noisy, image.Rect(0, 0, 4, 4), float64(0x4040) / 0xffff / 16},
+		{"region clipped by bounds", filled(4, 4, black), halfWhite, image.Rect(-2, 0, 2, 8), 0},
+		{"no intersection", filled(4, 4, black), filled(4, 4, black), image.Rect(8, 8, 10, 10), 1},
+	}
+
+	for _, tt := range tests {
+		if got := Difference(tt.a, tt.b, tt.r); !almostEqual(got, tt.want) {
+			t.Errorf("%s: Difference() = %.4f, want %.4f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAt(t *testing.T) {
+	// a white 2x2 square at (3, 4) on a black frame
+	frame := filled(8, 8, black)
+	fill(frame, image.Rect(3, 4, 5, 6), white)
+
+	square := filled(4, 4, black)
+	fill(square, image.Rect(1, 1, 3, 3), white)
+	// the reference has non-zero origin
+	ref := square.SubImage(image.Rect(1, 1, 3, 3))
+
+	noisy := filled(2, 2, white)
+	noisy.Set(0, 0, color.RGBA{0xe0, 0xe0, 0xe0, 0xff})
+
+	// the default tolerance of wait_match
+	const tolerance = 0.05
+
+	tests := []struct {
+		name    string
+		ref     image.Image
+		at      image.Point
+		want    float64
+		matched bool
+	}{
+		{"exact", ref, image.Pt(3, 4), 0, true},
+		{"shifted", ref, image.Pt(2, 4), 0.5, false},
+		{"other place", ref, image.Pt(0, 0), 1, false},
+		{"noise", noisy, image.Pt(3, 4), float64(0xffff-0xe0e0) / 0xffff / 4, true},
+		{"out of frame", ref, image.Pt(7, 7), 1, false},
+		{"negative point", ref, image.Pt(-1, 0), 1, false},
+	}
+
+	for _, tt := range tests {
+		d := MatchAt(frame, tt.ref, tt.at)
+		if !almostEqual(d, tt.want) || (d <= tolerance) != tt.matched {
+			t.Errorf("%s: MatchAt() = %.4f, want %.4f (matched %t)", tt.name, d, tt.want, tt.matched)
+		}
+	}
+}
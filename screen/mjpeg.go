@@ -0,0 +1,99 @@
+package screen
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"sync"
+)
+
+const (
+	markerSOI = 0xd8
+	markerDHT = 0xc4
+	markerSOS = 0xda
+)
+
+var defaultDHT []byte
+var defaultDHTOnce sync.Once
+
+// DecodeMJPEG decodes a frame of Motion JPEG.
+func DecodeMJPEG(data []byte) (image.Image, error) {
+	data, err := FixMJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// FixMJPEG returns a frame of Motion JPEG as a baseline JPEG image.
+// UVC devices may omit Huffman tables in frames, the default tables (ITU-T T.81 Annex K.3) are inserted in that case.
+func FixMJPEG(data []byte) ([]byte, error) {
+	hasDHT, err := hasHuffmanTables(data)
+	if err != nil {
+		return nil, err
+	}
+	if hasDHT {
+		return data, nil
+	}
+
+	defaultDHTOnce.Do(func() { defaultDHT = makeDefaultDHT() })
+
+	frame := make([]byte, 0, len(data)+len(defaultDHT))
+	frame = append(frame, data[:2]...) // SOI
+	frame = append(frame, defaultDHT...)
+	frame = append(frame, data[2:]...)
+
+	return frame, nil
+}
+
+// hasHuffmanTables returns true if a DHT segment is found before the first SOS segment.
+func hasHuffmanTables(data []byte) (bool, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return false, errors.New("not a JPEG image")
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return false, errors.New("invalid JPEG marker")
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+
+		switch marker {
+		case markerDHT:
+			return true, nil
+		case markerSOS:
+			return false, nil
+		}
+
+		length := int(data[i+2])<<8 | int(data[i+3])
+		i += 2 + length
+	}
+
+	return false, errors.New("SOS segment is not found")
+}
+
+// makeDefaultDHT returns DHT segments written by image/jpeg, which always uses the default tables.
+func makeDefaultDHT() []byte {
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	jpeg.Encode(&buf, img, nil)
+
+	data := buf.Bytes()
+	dht := []byte{}
+	for i := 2; i+4 <= len(data) && data[i+1] != markerSOS; {
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if data[i+1] == markerDHT {
+			dht = append(dht, data[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+
+	return dht
+}
@@ -0,0 +1,76 @@
+package screen
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// stripHuffmanTables removes DHT segments as UVC devices do.
+func stripHuffmanTables(data []byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	i := 2
+	for data[i+1] != markerSOS {
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if data[i+1] != markerDHT {
+			out = append(out, data[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+
+	return append(out, data[i:]...)
+}
+
+func TestFixMJPEG(t *testing.T) {
+	img := filled(16, 8, gray)
+	fill(img, image.Rect(0, 0, 8, 8), white)
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	stripped := stripHuffmanTables(encoded)
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err == nil {
+		t.Fatal("JPEG without Huffman tables is decoded")
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		same    bool
+		invalid bool
+	}{
+		{"with DHT", encoded, true, false},
+		{"without DHT", stripped, false, false},
+		{"not JPEG", []byte{0x89, 'P', 'N', 'G'}, false, true},
+		{"no SOS", encoded[:20], false, true},
+		{"empty", nil, false, true},
+	}
+
+	for _, tt := range tests {
+		fixed, err := FixMJPEG(tt.data)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: FixMJPEG() is not an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: FixMJPEG(): %v", tt.name, err)
+			continue
+		}
+		if tt.same && !bytes.Equal(fixed, tt.data) {
+			t.Errorf("%s: FixMJPEG() has changed the image", tt.name)
+		}
+
+		decoded, err := DecodeMJPEG(tt.data)
+		if err != nil {
+			t.Errorf("%s: DecodeMJPEG(): %v", tt.name, err)
+			continue
+		}
+		if d := Difference(img, decoded, img.Bounds()); d > 0.02 {
+			t.Errorf("%s: decoded image differs (difference: %.4f)", tt.name, d)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package screen
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	quarters := filled(4, 4, black)
+	fill(quarters, image.Rect(2, 0, 4, 2), white)
+	fill(quarters, image.Rect(0, 2, 2, 4), gray)
+
+	stripes := filled(2, 1, black)
+	stripes.Set(1, 0, white)
+
+	grayscale := image.NewGray(image.Rect(0, 0, 2, 2))
+	for i := range grayscale.Pix {
+		grayscale.Pix[i] = 0x80
+	}
+
+	tests := []struct {
+		name          string
+		img           image.Image
+		width, height int
+		want          []color.RGBA // pixels in row order
+	}{
+		{"shrink", quarters, 2, 2, []color.RGBA{black, white, gray, black}},
+		{"average", stripes, 1, 1, []color.RGBA{{0x7f, 0x7f, 0x7f, 0xff}}},
+		{"enlarge", stripes, 4, 1, []color.RGBA{black, black, white, white}},
+		{"sub image", quarters.SubImage(image.Rect(2, 0, 4, 2)), 1, 1, []color.RGBA{white}},
+		{"non-RGBA", grayscale, 1, 1, []color.RGBA{gray}},
+	}
+
+	for _, tt := range tests {
+		dst := Resize(tt.img, tt.width, tt.height)
+		if dst.Bounds() != image.Rect(0, 0, tt.width, tt.height) {
+			t.Errorf("%s: bounds = %v", tt.name, dst.Bounds())
+			continue
+		}
+		for i, want := range tt.want {
+			if got := dst.RGBAAt(i%tt.width, i/tt.width); got != want {
+				t.Errorf("%s: pixel %d = %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+}
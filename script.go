@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.starlark.net/starlark"
+)
+
+const (
+	defaultScriptDir = "scripts"
+	defaultMediaDir  = "media"
+	scriptFileExt    = ".star"
+	scriptFramesDir  = "frames" // in the script directory, for grab()
+
+	scriptClickDuration = 50 * time.Millisecond
+	scriptMaxRuns       = 20    // runs kept for the API
+	absolutePosMax      = 32767 // logical maximum of the absolute mouse
+)
+
+var mouseButtons = map[string]int{
+	"left":   0x01,
+	"right":  0x02,
+	"middle": 0x04,
+}
+
+type ScriptRunStatus struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Running  bool       `json:"running"`
+	Error    string     `json:"error,omitempty"`
+	Log      []string   `json:"log"`
+}
+
+type ScriptRun struct {
+	mutex      sync.Mutex
+	status     ScriptRunStatus
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	thread     *starlark.Thread
+}
+
+// scriptRuns are recent runs, the last one may be running.
+var scriptRuns []*ScriptRun
+var scriptRunsMutex sync.Mutex
+var lastScriptRunID int
+
+// number is a starlark int or float argument.
+type number float64
+
+func (n *number) Unpack(v starlark.Value) error {
+	f, ok := starlark.AsFloat(v)
+	if !ok {
+		return fmt.Errorf("got %s, want number", v.Type())
+	}
+	*n = number(f)
+
+	return nil
+}
+
+func seconds(n number) time.Duration {
+	return time.Duration(float64(n) * float64(time.Second))
+}
+
+// scriptPath returns the path of the file in the directory. The name must not go out of the directory.
+func scriptPath(dir, name string) (string, error) {
+	clean := filepath.Clean(name)
+	if len(name) == 0 || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid file name: %q", name)
+	}
+
+	return filepath.Join(dir, clean), nil
+}
+
+func listScripts() ([]string, error) {
+	files, err := ioutil.ReadDir(config.ScriptDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	scripts := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), scriptFileExt) {
+			scripts = append(scripts, strings.TrimSuffix(f.Name(), scriptFileExt))
+		}
+	}
+	sort.Strings(scripts)
+
+	return scripts, nil
+}
+
+func findScriptRun(id int) *ScriptRun {
+	scriptRunsMutex.Lock()
+	defer scriptRunsMutex.Unlock()
+
+	for _, r := range scriptRuns {
+		if r.status.ID == id {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (r *ScriptRun) logf(format string, a ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.status.Log = append(r.status.Log, time.Now().Format("15:04:05.000 ")+fmt.Sprintf(format, a...))
+}
+
+// Cancel stops the script. Waiting functions return immediately.
+func (r *ScriptRun) Cancel() {
+	r.cancelOnce.Do(func() { close(r.cancel) })
+	r.thread.Cancel("cancelled")
+}
+
+// Status returns a copy of the status for the API.
+func (r *ScriptRun) Status() ScriptRunStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := r.status
+	status.Log = append([]string{}, r.status.Log...)
+
+	return status
+}
+
+// startScript runs the script in background. Only one script runs at a time.
+// Scripts hold the keyboard job only while sending keys, other users can type while they wait for the screen.
+func startScript(name string) (*ScriptRun, error) {
+	path, err := scriptPath(config.ScriptDir, name+scriptFileExt)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ScriptRun{
+		status: ScriptRunStatus{Name: name, Started: time.Now(), Running: true, Log: []string{}},
+		cancel: make(chan struct{}),
+	}
+	r.thread = &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { r.logf("%s", msg) },
+	}
+
+	scriptRunsMutex.Lock()
+	for _, run := range scriptRuns {
+		if run.Status().Running {
+			scriptRunsMutex.Unlock()
+			return nil, fmt.Errorf("script %q is running", run.thread.Name)
+		}
+	}
+	lastScriptRunID++
+	r.status.ID = lastScriptRunID
+	scriptRuns = append(scriptRuns, r)
+	if len(scriptRuns) > scriptMaxRuns {
+		scriptRuns = scriptRuns[len(scriptRuns)-scriptMaxRuns:]
+	}
+	scriptRunsMutex.Unlock()
+
+	go func() {
+		_, err := starlark.ExecFile(r.thread, path, src, r.builtins())
+
+		r.mutex.Lock()
+		now := time.Now()
+		r.status.Finished = &now
+		r.status.Running = false
+		if err != nil {
+			if evalErr, ok := err.(*starlark.EvalError); ok {
+				r.status.Error = evalErr.Backtrace()
+			} else {
+				r.status.Error = err.Error()
+			}
+		}
+		r.mutex.Unlock()
+	}()
+
+	return r, nil
+}
+
+func (r *ScriptRun) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"type":        starlark.NewBuiltin("type", r.typeText),
+		"press":       starlark.NewBuiltin("press", r.press),
+		"preset":      starlark.NewBuiltin("preset", r.preset),
+		"move":        starlark.NewBuiltin("move", r.move),
+		"click":       starlark.NewBuiltin("click", r.click),
+		"mount":       starlark.NewBuiltin("mount", r.mount),
+		"eject":       starlark.NewBuiltin("eject", r.eject),
+		"run":         starlark.NewBuiltin("run", r.runCommand),
+		"grab":        starlark.NewBuiltin("grab", r.grab),
+		"wait_match":  starlark.NewBuiltin("wait_match", r.waitMatch),
+		"wait_static": starlark.NewBuiltin("wait_static", r.waitStatic),
+		"sleep":       starlark.NewBuiltin("sleep", r.sleep),
+	}
+}
+
+// startKeyboardJob holds the keyboard job during a key action. The job is cancelled with the script.
+// The returned function finishes the job.
+func (r *ScriptRun) startKeyboardJob() (*TypeJob, func(), error) {
+	j, err := startTypeJob(typeJobScript, r.thread.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.cancel:
+			j.Cancel()
+		case <-done:
+		}
+	}()
+
+	return j, func() {
+		close(done)
+		finishTypeJob(j)
+	}, nil
+}
+
+// wait waits for the duration. It returns an error if the script is cancelled.
+func (r *ScriptRun) wait(d time.Duration) error {
+	select {
+	case <-r.cancel:
+		return errors.New("cancelled")
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// type(text, layout="", delay=0)
+func (r *ScriptRun) typeText(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var req TypeTextRequest
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "text", &req.Text, "layout?", &req.Layout, "delay?", &req.Delay); err != nil {
+		return nil, err
+	}
+
+	k := ownerKeyboard()
+	if k == nil {
+		return nil, errors.New("keyboard is not enabled")
+	}
+
+	strokes, err := prepareText(req)
+	if err != nil {
+		return nil, err
+	}
+
+	j, finish, err := r.startKeyboardJob()
+	if err != nil {
+		return nil, err
+	}
+	defer finish()
+
+	p := typeText(k, strokes, req.Delay, j, nil)
+	if p.Cancelled {
+		return nil, errors.New("cancelled")
+	}
+	if len(p.Error) > 0 {
+		return nil, errors.New(p.Error)
+	}
+
+	return starlark.None, nil
+}
+
+// press(*codes): presses keys together, e.g. press("ControlLeft", "AltLeft", "Delete")
+func (r *ScriptRun) press(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", fn.Name())
+	}
+
+	codes := []string{}
+	for _, a := range args {
+		code, ok := starlark.AsString(a)
+		if !ok {
+			return nil, fmt.Errorf("%s: got %s, want string", fn.Name(), a.Type())
+		}
+		codes = append(codes, code)
+	}
+
+	chords, err := ConfigPreset{Name: fn.Name(), Keys: codes}.chords()
+	if err != nil {
+		return nil, err
+	}
+
+	k := ownerKeyboard()
+	if k == nil {
+		return nil, errors.New("keyboard is not enabled")
+	}
+
+	_, finish, err := r.startKeyboardJob()
+	if err != nil {
+		return nil, err
+	}
+	defer finish()
+
+	return starlark.None, pressKeys(k, chords[0], presetKeyDelay*time.Millisecond)
+}
+
+// preset(name)
+func (r *ScriptRun) preset(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+
+	p, ok := findPreset(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown preset: %s", name)
+	}
+
+	k := ownerKeyboard()
+	if k == nil {
+		return nil, errors.New("keyboard is not enabled")
+	}
+
+	j, finish, err := r.startKeyboardJob()
+	if err != nil {
+		return nil, err
+	}
+	defer finish()
+
+	result := sendPreset(k, p, j)
+	if result.Cancelled {
+		return nil, errors.New("cancelled")
+	}
+	if len(result.Error) > 0 {
+		return nil, errors.New(result.Error)
+	}
+
+	return starlark.None, nil
+}
+
+// absolutePos converts a position on the captured frame into the position of the absolute mouse.
+func absolutePos(x, y number) (int, int, error) {
+	f, err := frames.Latest(frameTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	img, err := f.Image()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	b := img.Bounds()
+	if x < 0 || int(x) >= b.Dx() || y < 0 || int(y) >= b.Dy() {
+		return 0, 0, fmt.Errorf("position (%v, %v) is out of the screen (%dx%d)", x, y, b.Dx(), b.Dy())
+	}
+
+	return int(float64(x) * absolutePosMax / float64(b.Dx())), int(float64(y) * absolutePosMax / float64(b.Dy())), nil
+}
+
+// move(x, y): moves the absolute mouse to the position on the captured frame
+func (r *ScriptRun) move(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x, y number
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "x", &x, "y", &y); err != nil {
+		return nil, err
+	}
+
+	_, d := ownerDevices()
+	if d.MouseAbs == nil {
+		return nil, errors.New("absolute mouse is not enabled")
+	}
+
+	absX, absY, err := absolutePos(x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.None, d.MouseAbs.Send(0, absX, absY)
+}
+
+// click(x, y, button="left", double=False)
+func (r *ScriptRun) click(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x, y number
+	button := "left"
+	double := false
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "x", &x, "y", &y, "button?", &button, "double?", &double); err != nil {
+		return nil, err
+	}
+
+	buttons, ok := mouseButtons[button]
+	if !ok {
+		return nil, fmt.Errorf("unknown button: %s", button)
+	}
+
+	_, d := ownerDevices()
+	m := d.MouseAbs
+	if m == nil {
+		return nil, errors.New("absolute mouse is not enabled")
+	}
+
+	absX, absY, err := absolutePos(x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 1
+	if double {
+		count = 2
+	}
+
+	if err := m.Send(0, absX, absY); err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		time.Sleep(scriptClickDuration)
+		if err := m.Send(buttons, absX, absY); err != nil {
+			return nil, err
+		}
+		time.Sleep(scriptClickDuration)
+		if err := m.Send(0, absX, absY); err != nil {
+			return nil, err
+		}
+	}
+
+	return starlark.None, nil
+}
+
+// mount(image, cdrom=False, readonly=False): inserts the image in the media directory into the virtual media
+func (r *ScriptRun) mount(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	cdrom, readOnly := false, false
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "image", &name, "cdrom?", &cdrom, "readonly?", &readOnly); err != nil {
+		return nil, err
+	}
+
+	path, err := scriptPath(config.MediaDir, name)
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, d := ownerDevices()
+	if d.MassStorage == nil {
+		return nil, errors.New("virtual media is not enabled")
+	}
+
+	r.logf("mount %s", path)
+
+	return starlark.None, d.MassStorage.Mount(path, cdrom, readOnly)
+}
+
+// eject()
+func (r *ScriptRun) eject(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+
+	_, d := ownerDevices()
+	if d.MassStorage == nil {
+		return nil, errors.New("virtual media is not enabled")
+	}
+
+	return starlark.None, d.MassStorage.Eject()
+}
+
+// run(name): runs the command in config.yaml and returns the exit code
+func (r *ScriptRun) runCommand(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range config.Commands {
+		if cmd.Name != name {
+			continue
+		}
+
+		r.logf("run command: %s", cmd.Command)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := exec.CommandContext(ctx, "sh", "-c", cmd.Command)
+		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		out := bytes.Buffer{}
+		c.Stdout = &out
+		c.Stderr = &out
+		if err := c.Start(); err != nil {
+			return nil, err
+		}
+
+		// the command is killed if the script is cancelled
+		go func() {
+			select {
+			case <-r.cancel:
+				// CommandContext kills only the shell, its children would keep the output open
+				syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := c.Wait()
+		if out.Len() > 0 {
+			r.logf("%s", strings.TrimRight(out.String(), "\n"))
+		}
+		if ctx.Err() != nil {
+			return nil, errors.New("cancelled")
+		}
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return starlark.MakeInt(exitErr.ExitCode()), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return starlark.MakeInt(0), nil
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", name)
+}
+
+// grab(filename): saves the current frame as PNG in the frames directory of scripts
+func (r *ScriptRun) grab(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "filename", &name); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(config.ScriptDir, scriptFramesDir)
+	path, err := scriptPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := frames.Latest(0)
+	if err != nil {
+		return nil, err
+	}
+	img, err := f.Image()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = png.Encode(file, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return starlark.String(path), nil
+}
+
+// wait_match(reference, x, y, tolerance=0.05, timeout=60):
+// waits until the region at (x, y) matches the reference image. It returns False on timeout.
+func (r *ScriptRun) waitMatch(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var x, y int
+	tolerance := number(defaultMatchTolerance)
+	timeout := number(defaultWaitTimeout)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "reference", &name, "x", &x, "y", &y, "tolerance?", &tolerance, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+
+	result, err := waitForMatch(name, image.Pt(x, y), float64(tolerance), seconds(timeout), r.cancel)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("%s: %+v", name, result)
+
+	return starlark.Bool(result.Matched), nil
+}
+
+// wait_static(seconds, tolerance=0.01, timeout=60):
+// waits until the screen does not change for the seconds. It returns False on timeout.
+func (r *ScriptRun) waitStatic(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var static number
+	tolerance := number(defaultStaticTolerance)
+	timeout := number(defaultWaitTimeout)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "seconds", &static, "tolerance?", &tolerance, "timeout?", &timeout); err != nil {
+		return nil, err
+	}
+
+	result, err := waitForStatic(seconds(static), float64(tolerance), seconds(timeout), r.cancel)
+	if err != nil {
+		return nil, err
+	}
+	r.logf("wait static: %+v", result)
+
+	return starlark.Bool(result.Static), nil
+}
+
+// sleep(seconds)
+func (r *ScriptRun) sleep(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var sec number
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "seconds", &sec); err != nil {
+		return nil, err
+	}
+
+	return starlark.None, r.wait(seconds(sec))
+}
+
+func scriptsEndpoint(c echo.Context) error {
+	scripts, err := listScripts()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, scripts)
+}
+
+func runScriptEndpoint(c echo.Context) error {
+	if _, err := scriptPath(config.ScriptDir, c.Param("name")+scriptFileExt); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	r, err := startScript(c.Param("name"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, r.Status())
+}
+
+func scriptRunsEndpoint(c echo.Context) error {
+	scriptRunsMutex.Lock()
+	runs := append([]*ScriptRun{}, scriptRuns...)
+	scriptRunsMutex.Unlock()
+
+	status := []ScriptRunStatus{}
+	for _, r := range runs {
+		status = append(status, r.Status())
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+func scriptRunEndpoint(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	r := findScriptRun(id)
+	if r == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "script run not found")
+	}
+
+	return c.JSON(http.StatusOK, r.Status())
+}
+
+func cancelScriptRunEndpoint(c echo.Context) error {
+	id, _ := strconv.Atoi(c.Param("id"))
+	r := findScriptRun(id)
+	if r == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "script run not found")
+	}
+	r.Cancel()
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/screen"
+)
+
+const (
+	defaultSnapshotQuality = 85
+	maxSnapshotSize        = 3840
+	// frames newer than this are served without waiting for the next frame
+	snapshotMaxAge = time.Second
+)
+
+// snapshotSize returns the size of the snapshot. The aspect ratio is kept if only width or height is specified.
+func snapshotSize(c echo.Context, frameWidth, frameHeight int) (int, int, error) {
+	width, err := intParam(c, "width", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	height, err := intParam(c, "height", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case width == 0 && height == 0:
+		width, height = frameWidth, frameHeight
+	case height == 0:
+		height = (frameHeight*width + frameWidth/2) / frameWidth
+	case width == 0:
+		width = (frameWidth*height + frameHeight/2) / frameHeight
+	}
+
+	if width < 1 || height < 1 || width > maxSnapshotSize || height > maxSnapshotSize {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("size must be 1 to %d", maxSnapshotSize))
+	}
+
+	return width, height, nil
+}
+
+// snapshotEndpoint returns the current frame as JPEG or PNG.
+func snapshotEndpoint(c echo.Context) error {
+	format := c.QueryParam("format")
+	if len(format) == 0 {
+		format = "jpeg"
+	}
+	if format != "jpeg" && format != "png" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported format: %s", format))
+	}
+
+	quality, err := intParam(c, "quality", 0)
+	if err != nil {
+		return err
+	}
+	if quality < 0 || quality > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "quality must be 0 (default) to 100")
+	}
+
+	f, err := frames.Latest(snapshotMaxAge)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+
+	data, err := screen.FixMJPEG(f.JPEG)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	imgConfig, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	width, height, err := snapshotSize(c, imgConfig.Width, imgConfig.Height)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Last-Modified", f.Time.UTC().Format(http.TimeFormat))
+
+	// the captured frame is returned as is if it is not converted
+	if format == "jpeg" && quality == 0 && width == imgConfig.Width && height == imgConfig.Height {
+		return c.Blob(http.StatusOK, "image/jpeg", data)
+	}
+
+	var img image.Image
+	img, err = f.Image()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if width != imgConfig.Width || height != imgConfig.Height {
+		img = screen.Resize(img, width, height)
+	}
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		if quality == 0 {
+			quality = defaultSnapshotQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.Blob(http.StatusOK, "image/"+format, buf.Bytes())
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/notedit/gst"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// MediaStream is a capture and encode pipeline shared by sessions.
+// The pipeline is started by the first subscriber and stopped after the last subscriber leaves.
+// Samples are written to one track which is added to peer connections of all subscribers.
+// The bitrate of the encoder follows the lowest bandwidth estimate of subscribers.
+// A failed or stalled pipeline is restarted with backoff while it has subscribers.
+type MediaStream struct {
+	Name   string
+	Track  *webrtc.TrackLocalStaticSample
+	Logger echo.Logger
+	// SetEncoderBitrate changes the bitrate of the element named encoder, nil if it is not supported
+	SetEncoderBitrate func(encoder *gst.Element, bitrate int)
+	// Ready returns an error if the failed pipeline can not be restarted yet, nil if it is not checked
+	Ready func() error
+
+	mutex sync.Mutex
+	// bandwidth estimates of subscribers in bps by source (twcc or remb)
+	subscribers map[*KVMContext]map[string]int
+	pipelineStr string
+	encoder     *gst.Element
+	// bitrate requested by the subscriber which started the pipeline
+	maxBitrate     int
+	bitrate        int
+	bitrateChanged time.Time
+	stop           chan struct{}
+	done           chan struct{}
+
+	// keyframeMutex guards sink and keyframeRequested.
+	// The writer of samples requests keyframes for recording while the stream waits for it to stop with the lock.
+	keyframeMutex sync.Mutex
+	sink          *gst.Element
+	// the last time when a keyframe is requested to the encoder
+	keyframeRequested time.Time
+
+	// stateMutex guards state and failures, which are updated by the writer of samples.
+	stateMutex sync.Mutex
+	state      StreamState
+	// failures since the pipeline has run healthy, for the backoff of restarts
+	failures uint
+}
+
+const (
+	minVideoBitrate = 100000 // bps
+	// share of the estimated bandwidth for video, the rest is for audio and headers
+	videoBandwidthPercent = 85
+	// the bitrate is decreased immediately, but increased at this interval
+	bitrateIncreaseInterval = 2 * time.Second
+	// requests from viewers (PLI/FIR) are merged into one keyframe in this interval
+	keyframeRequestInterval = 500 * time.Millisecond
+)
+
+// videoStreamName is the name of video streams of all codecs.
+const videoStreamName = "video"
+
+var audioStream = NewMediaStream("audio", webrtc.MimeTypeOpus)
+
+// videoStreams are streams by codec of available encoders.
+// Only one of them runs at a time, as they share the capture device.
+var videoStreams = map[string]*MediaStream{}
+
+// videoStreamsMutex serializes selection and subscription of video streams, and guards videoSettings.
+var videoStreamsMutex sync.Mutex
+
+// VideoSettings are settings of the running video stream, which are shared by all sessions.
+type VideoSettings struct {
+	Width         int          `json:"width"`
+	Height        int          `json:"height"`
+	Framerate     int          `json:"framerate"`
+	TargetBitrate int          `json:"targetBitrate"` // kbps
+	Encoder       VideoEncoder `json:"encoder"`
+	Layout        VideoLayout  `json:"layout"`
+}
+
+// request returns the request which reproduces the settings.
+func (s VideoSettings) request() VideoRequest {
+	return VideoRequest{
+		Width:         s.Width,
+		Height:        s.Height,
+		Framerate:     s.Framerate,
+		TargetBitrate: s.TargetBitrate,
+		ScaleMode:     s.Layout.Mode,
+	}
+}
+
+var videoSettings VideoSettings
+
+func NewMediaStream(name, mimeType string) *MediaStream {
+	track, _ := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, name, name)
+
+	return &MediaStream{
+		Name:        name,
+		Track:       track,
+		subscribers: map[*KVMContext]map[string]int{},
+		state:       StreamState{Name: name, MimeType: mimeType, State: streamStateStopped},
+	}
+}
+
+// Subscribe starts the pipeline if it is not running, and returns the track for the session.
+// The running pipeline is shared even if the session requests another pipeline.
+// The bitrate (bps, 0 if the stream has no bitrate control) is the initial and maximum bitrate of the started pipeline.
+func (s *MediaStream) Subscribe(c *KVMContext, pipelineStr string, bitrate int) (*webrtc.TrackLocalStaticSample, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop == nil {
+		err := s.start(pipelineStr, bitrate)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if pipelineStr != s.pipelineStr {
+			s.Logger.Infof("stream is shared with the running pipeline (name: %s)", s.Name)
+		}
+	}
+
+	s.subscribers[c] = map[string]int{}
+
+	return s.Track, nil
+}
+
+// Unsubscribe stops the pipeline if the session is the last subscriber.
+func (s *MediaStream) Unsubscribe(c *KVMContext) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.subscribers[c]; !ok {
+		return
+	}
+	delete(s.subscribers, c)
+
+	if len(s.subscribers) == 0 && s.stop != nil {
+		s.stopPipeline()
+		s.setState(streamStateStopped, "")
+		s.resetBackoff()
+		return
+	}
+
+	// remaining subscribers may receive a higher bitrate
+	s.adaptBitrate()
+}
+
+// Subscribers returns sessions which receive the stream.
+func (s *MediaStream) Subscribers() []*KVMContext {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subscribers := []*KVMContext{}
+	for c := range s.subscribers {
+		subscribers = append(subscribers, c)
+	}
+
+	return subscribers
+}
+
+// Restart replaces the running pipeline. Subscribers keep receiving the same track.
+func (s *MediaStream) Restart(pipelineStr string, bitrate int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop == nil {
+		return fmt.Errorf("stream is not running (name: %s)", s.Name)
+	}
+	previous, previousBitrate := s.pipelineStr, s.maxBitrate
+	s.stopPipeline()
+
+	err := s.start(pipelineStr, bitrate)
+	if err != nil {
+		// keep streaming with the previous pipeline
+		if err := s.start(previous, previousBitrate); err != nil {
+			s.Logger.Error(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SetMaxBitrate changes the maximum bitrate of the running pipeline without restarting it.
+func (s *MediaStream) SetMaxBitrate(bitrate int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.encoder == nil || s.SetEncoderBitrate == nil {
+		return fmt.Errorf("bitrate can not be changed while streaming (name: %s)", s.Name)
+	}
+
+	s.maxBitrate = bitrate
+	// the new maximum is applied immediately
+	s.bitrateChanged = time.Time{}
+	s.adaptBitrate()
+
+	return nil
+}
+
+// SetEstimate updates the bandwidth estimate of the subscriber.
+func (s *MediaStream) SetEstimate(c *KVMContext, source string, bitrate int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	estimates, ok := s.subscribers[c]
+	if !ok {
+		return
+	}
+	estimates[source] = bitrate
+
+	s.adaptBitrate()
+}
+
+// adaptBitrate sets the bitrate of the encoder to the lowest estimate of subscribers.
+// It must be called with the lock.
+func (s *MediaStream) adaptBitrate() {
+	if s.encoder == nil || s.SetEncoderBitrate == nil || s.maxBitrate == 0 {
+		return
+	}
+
+	bitrate := s.maxBitrate
+	for _, estimates := range s.subscribers {
+		for _, estimate := range estimates {
+			if b := estimate * videoBandwidthPercent / 100; b < bitrate {
+				bitrate = b
+			}
+		}
+	}
+	if bitrate < minVideoBitrate {
+		bitrate = minVideoBitrate
+	}
+
+	if bitrate == s.bitrate {
+		return
+	}
+	// small changes are ignored not to reconfigure the encoder too often, except the maximum
+	if bitrate != s.maxBitrate && bitrate > s.bitrate*9/10 && bitrate < s.bitrate*11/10 {
+		return
+	}
+	if bitrate > s.bitrate && time.Since(s.bitrateChanged) < bitrateIncreaseInterval {
+		return
+	}
+
+	s.SetEncoderBitrate(s.encoder, bitrate)
+	s.Logger.Debugf("bitrate changed (name: %s, bitrate: %d -> %d)", s.Name, s.bitrate, bitrate)
+	s.bitrate = bitrate
+	s.bitrateChanged = time.Now()
+}
+
+// Running returns true if the pipeline is running.
+func (s *MediaStream) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stop != nil
+}
+
+// Wait waits until the stopped pipeline releases the devices.
+func (s *MediaStream) Wait() {
+	s.mutex.Lock()
+	done := s.done
+	s.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// RequestKeyframe asks the encoder to emit a keyframe.
+func (s *MediaStream) RequestKeyframe() {
+	s.requestKeyframe(false)
+}
+
+// requestKeyframe asks the encoder to emit a keyframe.
+// Requests in keyframeRequestInterval are merged unless force is true.
+func (s *MediaStream) requestKeyframe(force bool) {
+	s.keyframeMutex.Lock()
+	defer s.keyframeMutex.Unlock()
+
+	if s.sink == nil || (!force && time.Since(s.keyframeRequested) < keyframeRequestInterval) {
+		return
+	}
+	s.keyframeRequested = time.Now()
+
+	if !requestKeyUnit(s.sink) {
+		s.Logger.Debugf("keyframe request is not handled (name: %s)", s.Name)
+	}
+}
+
+// hasSubscriber returns true if the session subscribes to the stream.
+func (s *MediaStream) hasSubscriber(c *KVMContext) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.subscribers[c]
+	return ok
+}
+
+// setSink changes the sink to which keyframes are requested.
+func (s *MediaStream) setSink(sink *gst.Element) {
+	s.keyframeMutex.Lock()
+	defer s.keyframeMutex.Unlock()
+
+	s.sink = sink
+}
+
+// stopPipeline must be called with the lock.
+func (s *MediaStream) stopPipeline() {
+	close(s.stop)
+	s.stop = nil
+	s.encoder = nil
+	s.setSink(nil)
+}
+
+// start must be called with the lock.
+func (s *MediaStream) start(pipelineStr string, bitrate int) error {
+	// the device is released after the previous pipeline has stopped
+	if s.done != nil {
+		<-s.done
+	}
+
+	pipeline, err := gst.ParseLaunch(fmt.Sprintf("%s ! appsink name=%s", pipelineStr, s.Name))
+	if err != nil {
+		return err
+	}
+
+	sink := pipeline.GetByName(s.Name)
+	s.pipelineStr = pipelineStr
+	s.setSink(sink)
+	s.encoder = pipeline.GetByName("encoder")
+	s.maxBitrate = bitrate
+	s.bitrate = bitrate
+	s.bitrateChanged = time.Now()
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.setState(streamStateStarting, "")
+	go s.writeSamplesFromGst(pipeline, sink, s.stop, s.done)
+
+	return nil
+}
+
+func (s *MediaStream) writeSamplesFromGst(pipeline *gst.Pipeline, element *gst.Element, stop, done chan struct{}) {
+	defer close(done)
+
+	// share JPEG frames of the capture device (for snapshots and scripts)
+	if frameSink := pipeline.GetByName(frameSinkName); frameSink != nil {
+		frames.AcquireSession()
+		defer frames.ReleaseSession()
+		go frames.PullFrom(frameSink)
+	}
+
+	if s.Name == videoStreamName {
+		videoRecorder.SetMimeType(s.Track.Codec().MimeType)
+	}
+
+	pipeline.SetState(gst.StatePlaying)
+	s.Logger.Infof("stream started (name: %s)", s.Name)
+
+	pulled := make(chan struct{})
+	sampled := make(chan struct{}, 1)
+	failure := make(chan string, 1)
+	go s.watch(pipeline, stop, pulled, sampled, failure)
+
+	defer func() {
+		close(pulled)
+		pipeline.SetState(gst.StateNull)
+		if s.Name == videoStreamName {
+			videoRecorder.Close()
+		}
+		s.Logger.Infof("stream closed (name: %s)", s.Name)
+
+		select {
+		case <-stop:
+			// stopped by the request
+		default:
+			reason := "end of stream"
+			select {
+			case reason = <-failure:
+			default:
+			}
+			// the lock is taken after done is closed, the stream may wait for it with the lock
+			go s.recover(stop, reason)
+		}
+	}()
+
+	count := 0
+	for {
+		sample, err := element.PullSample()
+		if err != nil || sample == nil {
+			if !element.IsEOS() {
+				s.Logger.Debugf("stream stopped (name: %s): %v", s.Name, err)
+			}
+			return
+		}
+
+		select {
+		case sampled <- struct{}{}:
+		default:
+		}
+		if count == 0 {
+			s.Logger.Infof("write first sample to stream (name: %s)", s.Name)
+			s.setState(streamStateRunning, "")
+		}
+		s.Logger.Debugf("write sample (name: %s, count: %d, duration: %d)", s.Name, count, sample.Duration)
+
+		err = s.Track.WriteSample(media.Sample{Data: sample.Data, Duration: time.Duration(sample.Duration)})
+		if err != nil {
+			s.Logger.Error(err)
+		}
+		videoRecorder.Write(s.Name, sample.Data)
+
+		count++
+	}
+}
+
+// validate checks settings of the request for the encoder.
+func (v VideoRequest) validate(e VideoEncoder) error {
+	if v.Width < 160 || v.Width > 3840 || v.Height < 120 || v.Height > 2160 {
+		return fmt.Errorf("invalid resolution: %dx%d", v.Width, v.Height)
+	}
+	if v.Framerate < 1 || v.Framerate > 120 {
+		return fmt.Errorf("invalid framerate: %d", v.Framerate)
+	}
+	if v.TargetBitrate < 100 || v.TargetBitrate > 25000 {
+		return fmt.Errorf("invalid bitrate: %d kbps", v.TargetBitrate)
+	}
+	// hardware encoders need a video size of a multiple of 16
+	if v.ScaleMode == scaleModeNative && e.Hardware {
+		return fmt.Errorf("scale mode %s is not supported by the hardware encoder: %s", scaleModeNative, e.Name)
+	}
+	_, err := videoLayout(v.ScaleMode, v.Width, v.Height)
+
+	return err
+}
+
+// supportsCodec returns true if the browser supports the codec. All codecs are supported if the browser does not tell them.
+func (v VideoRequest) supportsCodec(mimeType string) bool {
+	if len(v.Codecs) == 0 {
+		return true
+	}
+
+	for _, codec := range v.Codecs {
+		if strings.EqualFold(codec, mimeType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectVideoEncoder returns the encoder for the session.
+// The codec of the running stream is used if any, otherwise the requested codec or the first available codec supported by the browser.
+// It must be called with videoStreamsMutex.
+func selectVideoEncoder(v VideoRequest) (VideoEncoder, error) {
+	for _, e := range codecEncoders {
+		if !videoStreams[e.MimeType].Running() {
+			continue
+		}
+		if !v.supportsCodec(e.MimeType) {
+			return e, fmt.Errorf("video is streamed in %s which is not supported by the browser", e.MimeType)
+		}
+		return e, nil
+	}
+
+	if len(v.Codec) > 0 {
+		if e, ok := findCodecEncoder(v.Codec); ok && v.supportsCodec(e.MimeType) {
+			return e, nil
+		}
+	}
+
+	for _, e := range codecEncoders {
+		if v.supportsCodec(e.MimeType) {
+			return e, nil
+		}
+	}
+
+	return VideoEncoder{}, fmt.Errorf("no video codec is supported by the browser")
+}
+
+// subscribeVideo subscribes the video stream of the codec selected for the session, and returns settings of the stream.
+func subscribeVideo(c *KVMContext, v VideoRequest) (*webrtc.TrackLocalStaticSample, VideoSettings, error) {
+	videoStreamsMutex.Lock()
+	defer videoStreamsMutex.Unlock()
+
+	e, err := selectVideoEncoder(v)
+	if err != nil {
+		return nil, videoSettings, err
+	}
+
+	err = v.validate(e)
+	if err != nil {
+		return nil, videoSettings, err
+	}
+
+	pipelineStr, err := videoPipeline(v, e)
+	if err != nil {
+		return nil, videoSettings, err
+	}
+
+	// the capture device may be still used by the stream of another codec
+	for mimeType, s := range videoStreams {
+		if mimeType != e.MimeType {
+			s.Wait()
+		}
+	}
+
+	s := videoStreams[e.MimeType]
+	started := !s.Running()
+	track, err := s.Subscribe(c, pipelineStr, v.TargetBitrate*1000)
+	if err != nil {
+		return nil, videoSettings, err
+	}
+	if started {
+		layout, _ := videoLayout(v.ScaleMode, v.Width, v.Height)
+		videoSettings = VideoSettings{
+			Width:         v.Width,
+			Height:        v.Height,
+			Framerate:     v.Framerate,
+			TargetBitrate: v.TargetBitrate,
+			Encoder:       e,
+			Layout:        layout,
+		}
+	}
+
+	return track, videoSettings, nil
+}
+
+// changeVideoSettings applies settings to the video stream of the session, and returns sessions which receive the stream.
+// Only the bitrate of the running encoder is changed if possible, otherwise the pipeline is restarted behind the same track.
+func changeVideoSettings(c *KVMContext, v VideoRequest) (VideoSettings, []*KVMContext, error) {
+	videoStreamsMutex.Lock()
+	defer videoStreamsMutex.Unlock()
+
+	e := videoSettings.Encoder
+	err := v.validate(e)
+	if err != nil {
+		return videoSettings, nil, err
+	}
+
+	s, ok := videoStreams[e.MimeType]
+	subscribed := false
+	if ok {
+		for _, subscriber := range s.Subscribers() {
+			subscribed = subscribed || subscriber == c
+		}
+	}
+	if !subscribed {
+		return videoSettings, nil, fmt.Errorf("video is not streamed to the session")
+	}
+
+	layout, err := videoLayout(v.ScaleMode, v.Width, v.Height)
+	if err != nil {
+		return videoSettings, nil, err
+	}
+
+	resized := v.Width != videoSettings.Width || v.Height != videoSettings.Height || v.Framerate != videoSettings.Framerate ||
+		layout != videoSettings.Layout
+	if resized || s.SetMaxBitrate(v.TargetBitrate*1000) != nil {
+		pipelineStr, err := videoPipeline(v, e)
+		if err != nil {
+			return videoSettings, nil, err
+		}
+		err = s.Restart(pipelineStr, v.TargetBitrate*1000)
+		if err != nil {
+			return videoSettings, nil, err
+		}
+	}
+
+	videoSettings.Width = v.Width
+	videoSettings.Height = v.Height
+	videoSettings.Framerate = v.Framerate
+	videoSettings.TargetBitrate = v.TargetBitrate
+	videoSettings.Layout = layout
+
+	return videoSettings, s.Subscribers(), nil
+}
+
+// restartVideo restarts the running video stream with the current settings, e.g. after the source has changed.
+func restartVideo() error {
+	videoStreamsMutex.Lock()
+	defer videoStreamsMutex.Unlock()
+
+	e := videoSettings.Encoder
+	s, ok := videoStreams[e.MimeType]
+	if !ok || !s.Running() {
+		return nil
+	}
+
+	v := videoSettings.request()
+	pipelineStr, err := videoPipeline(v, e)
+	if err != nil {
+		return err
+	}
+
+	return s.Restart(pipelineStr, v.TargetBitrate*1000)
+}
+
+// videoSubscribers returns sessions which receive video.
+func videoSubscribers() []*KVMContext {
+	subscribers := []*KVMContext{}
+	for _, s := range videoStreams {
+		subscribers = append(subscribers, s.Subscribers()...)
+	}
+
+	return subscribers
+}
+
+// unsubscribeVideo unsubscribes video streams of all codecs.
+func unsubscribeVideo(c *KVMContext) {
+	for _, s := range videoStreams {
+		s.Unsubscribe(c)
+	}
+}
+
+// requestVideoKeyframe asks the encoder of the running video stream to emit a keyframe.
+func requestVideoKeyframe() {
+	for _, s := range videoStreams {
+		s.RequestKeyframe()
+	}
+}
+
+// requestSubscriberKeyframe asks the encoder of the video stream of the connected session to emit a keyframe.
+// Keyframes emitted before the connection are lost, and the session can not decode the stream until the next one,
+// so the request is not merged with recent ones.
+func requestSubscriberKeyframe(c *KVMContext) {
+	for _, s := range videoStreams {
+		if s.hasSubscriber(c) {
+			s.requestKeyframe(true)
+		}
+	}
+}
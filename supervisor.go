@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/notedit/gst"
+)
+
+// states of streams
+const (
+	streamStateStopped = "stopped"
+	// the pipeline is started but no sample is written yet
+	streamStateStarting = "starting"
+	streamStateRunning  = "running"
+	// the pipeline has failed and is restarted after the backoff
+	streamStateRestarting = "restarting"
+	// the pipeline can not be restarted, it is started again by the next subscriber
+	streamStateFailed = "failed"
+)
+
+const (
+	// the bus of the pipeline is checked at this interval
+	streamCheckInterval = time.Second
+	// the pipeline is restarted if no sample is written in this time
+	streamStallTimeout = 10 * time.Second
+	// the backoff of restarts doubles from the minimum to the maximum
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 30 * time.Second
+	// the backoff is reset after the pipeline runs in this time without failures
+	streamHealthyDuration = 30 * time.Second
+)
+
+// StreamState is the health of the pipeline of a stream, which is sent to subscribers when it changes.
+type StreamState struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	// failures which have restarted the pipeline
+	Restarts int       `json:"restarts"`
+	Changed  time.Time `json:"changed"`
+}
+
+// State returns the state of the pipeline.
+func (s *MediaStream) State() StreamState {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	return s.state
+}
+
+// setState records the state, and notifies subscribers if it has changed.
+func (s *MediaStream) setState(state, reason string) {
+	s.stateMutex.Lock()
+	if s.state.State == state && s.state.Error == reason {
+		s.stateMutex.Unlock()
+		return
+	}
+	if state == streamStateRestarting && s.state.State != streamStateRestarting {
+		s.state.Restarts++
+	}
+	s.state.State = state
+	s.state.Error = reason
+	s.state.Changed = time.Now()
+	current := s.state
+	s.stateMutex.Unlock()
+
+	// subscribers are locked by the stream while it waits for the writer of samples to stop
+	go func() {
+		for _, c := range s.Subscribers() {
+			sendMessage(c.WS, "streamState", current)
+		}
+	}()
+}
+
+// restartBackoff returns the delay before the next restart, and counts the failure.
+func (s *MediaStream) restartBackoff() time.Duration {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	backoff := minRestartBackoff << s.failures
+	if backoff <= 0 || backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	s.failures++
+
+	return backoff
+}
+
+// resetBackoff is called when the pipeline has run without failures.
+func (s *MediaStream) resetBackoff() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	s.failures = 0
+}
+
+// watch stops the pipeline on errors, EOS or stalled output, and returns the reason to the writer of samples.
+// The pipeline is stopped by the request, too. PullSample returns when the pipeline is stopped.
+func (s *MediaStream) watch(pipeline *gst.Pipeline, stop, pulled chan struct{}, sampled <-chan struct{}, failure chan<- string) {
+	defer pipeline.SetState(gst.StateNull)
+
+	bus := pipeline.GetBus()
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	lastSample := started
+	for {
+		select {
+		case <-stop:
+			return
+		case <-pulled:
+			return
+		case <-sampled:
+			lastSample = time.Now()
+		case <-ticker.C:
+			if reason := busFailure(bus); reason != "" {
+				failure <- reason
+				return
+			}
+			if time.Since(lastSample) > streamStallTimeout {
+				failure <- "no sample in " + streamStallTimeout.String()
+				return
+			}
+			if time.Since(started) > streamHealthyDuration {
+				s.resetBackoff()
+			}
+		}
+	}
+}
+
+// busFailure returns the error or EOS message on the bus, empty if the pipeline is healthy.
+func busFailure(bus *gst.Bus) string {
+	for bus.HavePending() {
+		m := bus.Pop()
+		if m.C == nil {
+			break
+		}
+		switch m.GetType() {
+		case gst.MessageError:
+			if text := errorMessage(m); len(text) > 0 {
+				return text
+			}
+			return "pipeline error"
+		case gst.MessageEos:
+			return "end of stream"
+		}
+	}
+
+	return ""
+}
+
+// recover restarts the failed pipeline after the backoff, unless it has been stopped or replaced meanwhile.
+// The restart is deferred while the device is not ready (e.g. the capture device is unplugged).
+func (s *MediaStream) recover(stop chan struct{}, reason string) {
+	s.Logger.Warnf("stream failed (name: %s): %s", s.Name, reason)
+	s.setState(streamStateRestarting, reason)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.restartBackoff()):
+		}
+
+		s.mutex.Lock()
+		if s.stop != stop {
+			s.mutex.Unlock()
+			return
+		}
+		if s.Ready != nil {
+			if err := s.Ready(); err != nil {
+				s.mutex.Unlock()
+				s.Logger.Warnf("stream is waiting for the device (name: %s): %s", s.Name, err)
+				s.setState(streamStateRestarting, err.Error())
+				continue
+			}
+		}
+
+		s.Logger.Infof("restart stream (name: %s)", s.Name)
+		pipelineStr, bitrate := s.pipelineStr, s.maxBitrate
+		s.stopPipeline()
+		err := s.start(pipelineStr, bitrate)
+		s.mutex.Unlock()
+		if err != nil {
+			s.Logger.Error(err)
+			s.setState(streamStateFailed, err.Error())
+		}
+		return
+	}
+}
+
+// streamStates returns states of the audio stream and video streams of all codecs.
+func streamStates() []StreamState {
+	states := []StreamState{audioStream.State()}
+	for _, e := range codecEncoders {
+		states = append(states, videoStreams[e.MimeType].State())
+	}
+
+	return states
+}
+
+func streamsEndpoint(c echo.Context) error {
+	return c.JSON(http.StatusOK, streamStates())
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/screen"
+)
+
+const (
+	defaultTimelineDir       = "timeline"
+	defaultTimelineWidth     = 320
+	defaultTimelineMaxFrames = 2880 // 24 hours at 30 sec interval
+	timelineQuality          = 75
+	timelineFileExt          = ".jpg"
+	// file names are the capture time in UTC
+	timelineTimeFormat = "20060102T150405.000Z"
+)
+
+// TimelineEntry is a thumbnail of the timeline.
+type TimelineEntry struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+}
+
+// Timeline stores thumbnails of the screen periodically.
+// The oldest thumbnails are removed when the number of thumbnails exceeds MaxFrames.
+type Timeline struct {
+	Dir       string
+	Width     int
+	MaxFrames int
+
+	mutex   sync.Mutex
+	entries []TimelineEntry
+}
+
+var timeline = &Timeline{}
+
+// load reads existing thumbnails in the directory.
+func (t *Timeline) load() error {
+	err := os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return err
+	}
+
+	entries := []TimelineEntry{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, timelineFileExt) {
+			continue
+		}
+		at, err := time.Parse(timelineTimeFormat, strings.TrimSuffix(name, timelineFileExt))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, TimelineEntry{Time: at, Name: name})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	t.mutex.Lock()
+	t.entries = entries
+	t.mutex.Unlock()
+
+	return t.prune()
+}
+
+// Run stores a thumbnail every interval.
+func (t *Timeline) Run(interval time.Duration) {
+	err := t.load()
+	if err != nil {
+		frames.Logger.Errorf("timeline: %s", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		f, err := frames.Latest(interval / 2)
+		if err != nil {
+			frames.Logger.Warnf("timeline: %s", err)
+			continue
+		}
+
+		err = t.add(f)
+		if err != nil {
+			frames.Logger.Errorf("timeline: %s", err)
+		}
+	}
+}
+
+func (t *Timeline) add(f *Frame) error {
+	img, err := f.Image()
+	if err != nil {
+		return err
+	}
+
+	b := img.Bounds()
+	height := b.Dy() * t.Width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, screen.Resize(img, t.Width, height), &jpeg.Options{Quality: timelineQuality})
+	if err != nil {
+		return err
+	}
+
+	at := f.Time.UTC().Truncate(time.Millisecond)
+	entry := TimelineEntry{Time: at, Name: at.Format(timelineTimeFormat) + timelineFileExt}
+	err = ioutil.WriteFile(filepath.Join(t.Dir, entry.Name), buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.entries = append(t.entries, entry)
+	t.mutex.Unlock()
+
+	return t.prune()
+}
+
+// prune removes the oldest thumbnails exceeding MaxFrames.
+func (t *Timeline) prune() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.entries) > t.MaxFrames {
+		err := os.Remove(filepath.Join(t.Dir, t.entries[0].Name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		t.entries = t.entries[1:]
+	}
+
+	return nil
+}
+
+// Entries returns thumbnails captured between from and to (zero time is unbounded).
+func (t *Timeline) Entries(from, to time.Time) []TimelineEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := []TimelineEntry{}
+	for _, entry := range t.entries {
+		if !from.IsZero() && entry.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && entry.Time.After(to) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Find returns the thumbnail captured at or just before the time.
+func (t *Timeline) Find(at time.Time) (TimelineEntry, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := sort.Search(len(t.entries), func(i int) bool { return t.entries[i].Time.After(at) })
+	if i == 0 {
+		return TimelineEntry{}, false
+	}
+
+	return t.entries[i-1], true
+}
+
+// has returns true if the name is a thumbnail of the timeline.
+func (t *Timeline) has(name string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, entry := range t.entries {
+		if entry.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func timeParam(c echo.Context, name string) (time.Time, error) {
+	s := c.QueryParam(name)
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+
+	at, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, "invalid "+name+": "+s)
+	}
+
+	return at, nil
+}
+
+// timelineEndpoint returns thumbnails captured between from and to (RFC 3339).
+func timelineEndpoint(c echo.Context) error {
+	from, err := timeParam(c, "from")
+	if err != nil {
+		return err
+	}
+	to, err := timeParam(c, "to")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, timeline.Entries(from, to))
+}
+
+// timelineAtEndpoint returns the thumbnail captured at or just before the time.
+func timelineAtEndpoint(c echo.Context) error {
+	at, err := timeParam(c, "time")
+	if err != nil {
+		return err
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	entry, ok := timeline.Find(at)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "no thumbnail is captured before the time")
+	}
+
+	return c.File(filepath.Join(timeline.Dir, entry.Name))
+}
+
+func timelineImageEndpoint(c echo.Context) error {
+	name := c.Param("name")
+	if !timeline.has(name) {
+		return echo.NewHTTPError(http.StatusNotFound, "thumbnail is not found: "+name)
+	}
+
+	return c.File(filepath.Join(timeline.Dir, name))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/msawahara/ipkvm/keymap"
+	"github.com/msawahara/ipkvm/usbgadget"
+)
+
+const (
+	defaultKeyboardLayout = "us"
+	defaultTypeDelay      = 20 // msec
+	typeProgressInterval  = 200 * time.Millisecond
+	// releases are retried while the report queue is full
+	keyReleaseTimeout = 2 * time.Second
+	keyRetryInterval  = 20 * time.Millisecond
+)
+
+type TypeTextRequest struct {
+	Text   string `json:"text"`
+	Layout string `json:"layout"`
+	Delay  int    `json:"delay"` // msec, between key events
+}
+
+type TypeTextProgress struct {
+	Typed     int    `json:"typed"`
+	Total     int    `json:"total"`
+	Done      bool   `json:"done"`
+	Cancelled bool   `json:"cancelled"`
+	Error     string `json:"error,omitempty"`
+}
+
+// kinds of keyboard jobs
+const (
+	typeJobText   = "text"
+	typeJobPreset = "preset"
+	typeJobMacro  = "macro"
+	typeJobScript = "script"
+)
+
+type TypeJob struct {
+	// kind and name (preset, macro or script) of the job, to cancel only the requested one
+	Kind string
+	Name string
+
+	cancel chan struct{}
+	once   sync.Once
+}
+
+// typeJob is the running job (typing text or sending a preset).
+// Only one job runs at a time because there is only one keyboard.
+var typeJob *TypeJob
+var typeJobMutex sync.Mutex
+
+func (j *TypeJob) String() string {
+	if len(j.Name) == 0 {
+		return j.Kind
+	}
+
+	return fmt.Sprintf("%s %q", j.Kind, j.Name)
+}
+
+func (j *TypeJob) Cancel() {
+	j.once.Do(func() { close(j.cancel) })
+}
+
+func startTypeJob(kind, name string) (*TypeJob, error) {
+	typeJobMutex.Lock()
+	defer typeJobMutex.Unlock()
+
+	if typeJob != nil {
+		return nil, fmt.Errorf("keyboard is busy (%s is running)", typeJob)
+	}
+	typeJob = &TypeJob{Kind: kind, Name: name, cancel: make(chan struct{})}
+
+	return typeJob, nil
+}
+
+func finishTypeJob(j *TypeJob) {
+	typeJobMutex.Lock()
+	defer typeJobMutex.Unlock()
+
+	if typeJob == j {
+		typeJob = nil
+	}
+}
+
+// cancelTypeJob cancels the running job of the kind, and of the name unless it is empty.
+func cancelTypeJob(kind, name string) bool {
+	typeJobMutex.Lock()
+	defer typeJobMutex.Unlock()
+
+	if typeJob == nil || typeJob.Kind != kind || (len(name) > 0 && typeJob.Name != name) {
+		return false
+	}
+	typeJob.Cancel()
+
+	return true
+}
+
+// ownerKeyboard returns the keyboard of the session which owns the USB gadget.
+func ownerKeyboard() *usbgadget.USBGadgetKeyboard {
+	_, d := ownerDevices()
+
+	return d.Keyboard
+}
+
+// prepareText converts the text into strokes. All characters are checked before typing.
+func prepareText(r TypeTextRequest) ([][]keymap.Stroke, error) {
+	layoutName := r.Layout
+	if len(layoutName) == 0 {
+		layoutName = config.KeyboardLayout
+	}
+
+	layout, err := keymap.Get(layoutName)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.ReplaceAll(r.Text, "\r\n", "\n")
+	strokes := [][]keymap.Stroke{}
+	for _, ch := range text {
+		s, ok := layout.Strokes(ch)
+		if !ok {
+			return nil, fmt.Errorf("character %q is not available on %s layout", ch, layout.Name)
+		}
+		strokes = append(strokes, s)
+	}
+
+	return strokes, nil
+}
+
+// pressKeys presses keys in order and releases them in reverse order.
+// Some firmwares miss keys if modifier keys and the key are pressed at the same time, so they are pressed one by one.
+func pressKeys(k *usbgadget.USBGadgetKeyboard, keys []int, delay time.Duration) error {
+	var err error
+	pressed := 0
+	for _, key := range keys {
+		if err = k.KeyDown(key); err != nil {
+			break
+		}
+		pressed++
+		time.Sleep(delay)
+	}
+
+	// always release pressed keys
+	for i := pressed - 1; i >= 0; i-- {
+		if releaseErr := releaseKey(k, keys[i]); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+		if i > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	return err
+}
+
+// typeStroke presses and releases the key with modifier keys.
+// releaseKey releases the key, it waits for the writer while the report queue is full not to leave the key pressed.
+func releaseKey(k *usbgadget.USBGadgetKeyboard, key int) error {
+	deadline := time.Now().Add(keyReleaseTimeout)
+	for {
+		err := k.KeyUp(key)
+		if !errors.Is(err, usbgadget.ErrQueueFull) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(keyRetryInterval)
+	}
+}
+
+func typeStroke(k *usbgadget.USBGadgetKeyboard, s keymap.Stroke, delay time.Duration) error {
+	return pressKeys(k, append(s.Modifiers(), s.Code), delay)
+}
+
+func typeText(k *usbgadget.USBGadgetKeyboard, strokes [][]keymap.Stroke, delayMs int, j *TypeJob, progress func(TypeTextProgress)) TypeTextProgress {
+	if delayMs <= 0 {
+		delayMs = defaultTypeDelay
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+
+	p := TypeTextProgress{Total: len(strokes)}
+	lastProgress := time.Now()
+
+	for i, ss := range strokes {
+		for _, s := range ss {
+			err := typeStroke(k, s, delay)
+			if err != nil {
+				p.Error = err.Error()
+				return p
+			}
+
+			select {
+			case <-j.cancel:
+				p.Cancelled = true
+				return p
+			case <-time.After(delay):
+			}
+		}
+
+		p.Typed = i + 1
+		if progress != nil && time.Since(lastProgress) >= typeProgressInterval {
+			progress(p)
+			lastProgress = time.Now()
+		}
+	}
+	p.Done = true
+
+	return p
+}
+
+func onTypeTextRequest(c *KVMContext, wsReq WSRequest) {
+	var r TypeTextRequest
+	json.Unmarshal(wsReq.Payload, &r)
+
+	if c.Keyboard == nil {
+		sendError(c.WS, "keyboard is not enabled")
+		return
+	}
+
+	strokes, err := prepareText(r)
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	j, err := startTypeJob(typeJobText, "")
+	if err != nil {
+		sendError(c.WS, err.Error())
+		return
+	}
+
+	k := c.Keyboard
+	go func() {
+		defer finishTypeJob(j)
+
+		p := typeText(k, strokes, r.Delay, j, func(p TypeTextProgress) {
+			sendMessage(c.WS, "typeTextProgress", p)
+		})
+		sendMessage(c.WS, "typeTextProgress", p)
+		c.Echo.Logger().Infof("type text: %+v", p)
+	}()
+}
+
+func onTypeTextCancel(c *KVMContext, wsReq WSRequest) {
+	cancelTypeJob(typeJobText, "")
+}
+
+func typeTextEndpoint(c echo.Context) error {
+	var r TypeTextRequest
+	if err := c.Bind(&r); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	k := ownerKeyboard()
+	if k == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "keyboard is not enabled")
+	}
+
+	strokes, err := prepareText(r)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	j, err := startTypeJob(typeJobText, "")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	defer finishTypeJob(j)
+
+	// cancel if the client has gone
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			j.Cancel()
+		case <-done:
+		}
+	}()
+
+	p := typeText(k, strokes, r.Delay, j, nil)
+
+	return c.JSON(http.StatusOK, p)
+}
+
+func typeTextCancelEndpoint(c echo.Context) error {
+	if !cancelTypeJob(typeJobText, "") {
+		return echo.NewHTTPError(http.StatusNotFound, "typing is not in progress")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package usbgadget
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+/* device node lookup settings */
+const (
+	HID_DEVICE_TIMEOUT       time.Duration = 2 * time.Second
+	HID_DEVICE_POLL_INTERVAL time.Duration = 20 * time.Millisecond
+)
+
+var (
+	// ErrFunctionNotFound is returned if the function is not created in configfs (e.g. gadget is not started).
+	ErrFunctionNotFound = errors.New("USB gadget function not found")
+	// ErrDeviceNotReady is returned if the device node is not created yet.
+	ErrDeviceNotReady = errors.New("HID device not ready")
+)
+
+type DeviceError struct {
+	Path string
+	Err  error
+}
+
+func (e *DeviceError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// getDeviceName resolves the device node path from the device number ("major:minor").
+func getDeviceName(devNum string) (string, error) {
+	data, err := ioutil.ReadFile(sysDevCharDir + "/" + devNum + "/uevent")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "DEVNAME=") {
+			return devDir + "/" + strings.TrimPrefix(line, "DEVNAME="), nil
+		}
+	}
+
+	return "", errors.New("DEVNAME not found in uevent")
+}
+
+// decodeDeviceNumber splits a device number into major and minor numbers.
+// (same encoding as gnu_dev_major() and gnu_dev_minor() of glibc)
+func decodeDeviceNumber(rdev uint64) (uint64, uint64) {
+	major := ((rdev >> 8) & 0x00000fff) | ((rdev >> 32) & 0xfffff000)
+	minor := (rdev & 0x000000ff) | ((rdev >> 12) & 0xffffff00)
+
+	return major, minor
+}
@@ -0,0 +1,28 @@
+package usbgadget
+
+import "testing"
+
+func TestDecodeDeviceNumber(t *testing.T) {
+	tests := []struct {
+		rdev         uint64
+		major, minor uint64
+	}{
+		{0x0801, 8, 1},
+		{0xec00, 236, 0},
+		{0xec03, 236, 3},
+		// minor > 255 is stored in bits 20-31
+		{0x10ec00, 236, 256},
+		{0x12300045 | 0xec00, 236, 0x12345},
+		// major > 4095 is stored in bits 44-63
+		{0x100000000000, 4096, 0},
+		{0x100012300045 | 0x0f00, 0x100f, 0x12345},
+		{0xffffffffffffffff, 0xffffffff, 0xffffffff},
+	}
+
+	for _, tt := range tests {
+		major, minor := decodeDeviceNumber(tt.rdev)
+		if major != tt.major || minor != tt.minor {
+			t.Errorf("decodeDeviceNumber(%#x) = %d:%d, want %d:%d", tt.rdev, major, minor, tt.major, tt.minor)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package usbgadget
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type USBGadgetMassStorage struct {
+	LunDir string
+}
+
+// AddMassStorage adds a mass storage function with a removable LUN.
+// The LUN is empty until an image is inserted by Mount.
+func (g USBGadget) AddMassStorage(name string) *USBGadgetMassStorage {
+	f := new(USBGadgetFunction)
+	f.Type = "mass_storage"
+
+	m := new(USBGadgetMassStorage)
+	m.LunDir = getGadgetDir(g.Name) + fmt.Sprintf("/functions/%s.%s/lun.0", f.Type, name)
+	g.AddFunction(name, f)
+
+	return m
+}
+
+// Mount inserts the image file into the LUN. The host sees a media change.
+func (m *USBGadgetMassStorage) Mount(file string, cdrom, readOnly bool) error {
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+
+	// cdrom and ro can be changed only when no media is inserted
+	err := m.Eject()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(m.LunDir+"/cdrom", []byte(boolAttr(cdrom)), 0644)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(m.LunDir+"/ro", []byte(boolAttr(readOnly || cdrom)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(m.LunDir+"/file", []byte(file), 0644)
+}
+
+// Eject removes the media from the LUN, even if the host prevents medium removal.
+func (m *USBGadgetMassStorage) Eject() error {
+	media, err := m.Media()
+	if err != nil || len(media) == 0 {
+		return err
+	}
+
+	if _, err := os.Stat(m.LunDir + "/forced_eject"); err == nil {
+		return ioutil.WriteFile(m.LunDir+"/forced_eject", []byte("1"), 0200)
+	}
+
+	return ioutil.WriteFile(m.LunDir+"/file", []byte("\n"), 0644)
+}
+
+// Media returns the image file inserted into the LUN, or empty string if no media is inserted.
+func (m *USBGadgetMassStorage) Media() (string, error) {
+	data, err := ioutil.ReadFile(m.LunDir + "/file")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errors.New("mass storage function is not started")
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func boolAttr(b bool) string {
+	if b {
+		return "1"
+	}
+
+	return "0"
+}
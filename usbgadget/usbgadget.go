@@ -4,12 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 /* device information */
@@ -24,6 +25,12 @@ const (
 	USB_DESC_PRODUCT_NAME string = "Generic USB Device"
 )
 
+/* configuration attributes (bmAttributes) */
+const (
+	USB_CONFIG_ATTR_ONE           int = 0x80 // reserved, must be set
+	USB_CONFIG_ATTR_REMOTE_WAKEUP int = 0x20 // remote wakeup
+)
+
 /* USB subclass */
 const (
 	USB_SUBCLASS_NO_SUBCLASS    int = 0
@@ -37,13 +44,39 @@ const (
 	USB_PROTOCOL_MOUSE    int = 2
 )
 
+/* keyboard usage IDs (in Keyboard/Keypad Page) */
+const (
+	KEY_ERROR_ROLL_OVER byte = 0x01
+	KEY_LEFT_CONTROL    int  = 0xe0
+	KEY_RIGHT_GUI       int  = 0xe7
+)
+
 type USBGadgetDevice struct {
 	ConfigDir string
 	Device    string
+
+	mutex sync.Mutex
+	file  *os.File
+	queue []hidReport
+	merge mergeFunc
+	// reports are not dropped (e.g. relative movements)
+	lossless bool
+	stats    HIDStats
+	closed   bool
+	wake     chan struct{}
+	closing  chan struct{}
+	done     chan struct{}
 }
 
 type USBGadgetMouse struct {
 	Device USBGadgetDevice
+
+	highResolution bool
+	mutex          sync.Mutex
+	remainderX     float64
+	remainderY     float64
+	// buttons of the last queued report
+	buttons int
 }
 
 type USBGadgetMouseAbsolute struct {
@@ -56,6 +89,10 @@ type USBGadgetTouchScreen struct {
 
 type USBGadgetKeyboard struct {
 	Device USBGadgetDevice
+
+	mutex    sync.Mutex
+	modifier int
+	keys     []int
 }
 
 type USBGadgetGamePad struct {
@@ -69,6 +106,7 @@ type USBGadgetFunction struct {
 	NoOutEndpoint    bool
 	ReportLength     int
 	ReportDescriptor []byte
+	Device           *USBGadgetDevice
 }
 
 type USBGadgetStringDescriptor struct {
@@ -84,11 +122,15 @@ type USBGadget struct {
 	IdProduct     int
 	UsbVersion    int
 	DeviceVesion  int
+	Attributes    int
 	Strings       map[int]*USBGadgetStringDescriptor
 	Functions     map[string]*USBGadgetFunction
 }
 
 var configFsDir string = "/sys/kernel/config"
+var udcDir string = "/sys/class/udc"
+var sysDevCharDir string = "/sys/dev/char"
+var devDir string = "/dev"
 
 func getGadgetDir(gadgetName string) string {
 	return configFsDir + "/usb_gadget/" + gadgetName
@@ -105,99 +147,216 @@ func min(a, b int) int {
 	return a
 }
 
+func clamp(v, lower, upper int) int {
+	if v < lower {
+		return lower
+	}
+	if v > upper {
+		return upper
+	}
+	return v
+}
+
+// Get returns the path of the device node (e.g. /dev/hidg0).
+// It does not wait for udev, ErrDeviceNotReady is returned if the node is not created yet.
 func (d *USBGadgetDevice) Get() (string, error) {
 	if len(d.Device) != 0 {
 		return d.Device, nil
 	}
 
-	data, _ := ioutil.ReadFile(d.ConfigDir + "/dev")
-	ids := strings.Split(strings.TrimRight(string(data), "\n"), ":")
-	major, _ := strconv.Atoi(ids[0])
-	minor, _ := strconv.Atoi(ids[1])
+	data, err := ioutil.ReadFile(d.ConfigDir + "/dev")
+	if err != nil {
+		return "", &DeviceError{Path: d.ConfigDir, Err: ErrFunctionNotFound}
+	}
+	devNum := strings.TrimSpace(string(data))
 
-	files, _ := ioutil.ReadDir("/dev")
-	for _, file := range files {
-		if (file.Mode() & os.ModeCharDevice) == 0 {
-			continue
-		}
-		name := "/dev/" + file.Name()
-		stat := syscall.Stat_t{}
-		syscall.Stat(name, &stat)
-		majorDev := int64(stat.Rdev / 256)
-		minorDev := int64(stat.Rdev % 256)
-		if major == int(majorDev) && minor == int(minorDev) {
-			d.Device = name
-			break
-		}
+	var major, minor uint64
+	if _, err := fmt.Sscanf(devNum, "%d:%d", &major, &minor); err != nil {
+		return "", &DeviceError{Path: d.ConfigDir + "/dev", Err: err}
+	}
+
+	name, err := getDeviceName(devNum)
+	if err != nil {
+		return "", &DeviceError{Path: sysDevCharDir + "/" + devNum, Err: err}
 	}
 
-	if len(d.Device) == 0 {
-		return "", errors.New("device not found")
+	stat := syscall.Stat_t{}
+	err = syscall.Stat(name, &stat)
+	if err != nil || (stat.Mode&syscall.S_IFMT) != syscall.S_IFCHR {
+		return "", &DeviceError{Path: name, Err: ErrDeviceNotReady}
 	}
+	// the node may be a stale one which has another device number
+	rdevMajor, rdevMinor := decodeDeviceNumber(uint64(stat.Rdev))
+	if rdevMajor != major || rdevMinor != minor {
+		return "", &DeviceError{Path: name, Err: ErrDeviceNotReady}
+	}
+
+	d.Device = name
 
 	return d.Device, nil
 }
 
-func (k *USBGadgetKeyboard) Send(code []int, altKey, ctrlKey, metaKey, shiftKey bool) error {
-	dev, err := k.Device.Get()
-	if err != nil {
-		return err
+// WaitReady waits until the device node is created by udev, or the deadline.
+func (d *USBGadgetDevice) WaitReady(deadline time.Time) error {
+	for {
+		d.mutex.Lock()
+		_, err := d.Get()
+		d.mutex.Unlock()
+		if err == nil || !errors.Is(err, ErrDeviceNotReady) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(HID_DEVICE_POLL_INTERVAL)
 	}
+}
 
-	modifier := byte(0)
+func isModifierKey(usage int) bool {
+	return KEY_LEFT_CONTROL <= usage && usage <= KEY_RIGHT_GUI
+}
+
+// KeyDown presses the key. usage is an usage ID in Keyboard/Keypad Page.
+// The key is not pressed if the report is not queued (e.g. ErrQueueFull).
+func (k *USBGadgetKeyboard) KeyDown(usage int) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
 
-	if ctrlKey {
-		modifier |= 1
+	if isModifierKey(usage) {
+		return k.send(k.modifier|1<<(usage-KEY_LEFT_CONTROL), k.keys)
 	}
-	if shiftKey {
-		modifier |= 2
+
+	for _, c := range k.keys {
+		if c == usage {
+			return nil
+		}
 	}
-	if altKey {
-		modifier |= 4
+	keys := append(append([]int{}, k.keys...), usage)
+
+	return k.send(k.modifier, keys)
+}
+
+// KeyUp releases the key.
+// The key is kept pressed if the report is not queued.
+func (k *USBGadgetKeyboard) KeyUp(usage int) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if isModifierKey(usage) {
+		return k.send(k.modifier&^(1<<(usage-KEY_LEFT_CONTROL)), k.keys)
 	}
-	if metaKey {
-		modifier |= 8
+
+	for i, c := range k.keys {
+		if c == usage {
+			keys := append(append([]int{}, k.keys[:i]...), k.keys[i+1:]...)
+			return k.send(k.modifier, keys)
+		}
 	}
 
-	report_keys := code[:min(6, len(code))]
+	return nil
+}
 
-	report := make([]byte, 8)
-	report[0] = modifier // Modifier
-	report[1] = 0        // Reserved
-	for i, c := range report_keys {
-		report[2+i] = byte(c) // Keycodes
-	}
+// ReleaseAll releases all keys including modifier keys.
+func (k *USBGadgetKeyboard) ReleaseAll() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.send(0, nil)
+}
 
-	err = ioutil.WriteFile(dev, report, 0600)
+// IsPressed returns true if any key is pressed.
+func (k *USBGadgetKeyboard) IsPressed() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
 
-	return err
+	return k.modifier != 0 || len(k.keys) != 0
 }
 
-func (m *USBGadgetMouse) Send(buttons, x, y int) error {
-	dev, err := m.Device.Get()
-	if err != nil {
+// send queues the report of the keys, and updates the state if it is queued.
+func (k *USBGadgetKeyboard) send(modifier int, keys []int) error {
+	report := make([]byte, 8)
+	report[0] = byte(modifier) // Modifier
+	report[1] = 0              // Reserved
+	if len(keys) > 6 {
+		// too many keys are pressed
+		for i := 0; i < 6; i++ {
+			report[2+i] = KEY_ERROR_ROLL_OVER
+		}
+	} else {
+		for i, c := range keys {
+			report[2+i] = byte(c) // Keycodes
+		}
+	}
+
+	if err := k.Device.Write(report, false); err != nil {
 		return err
 	}
+	k.modifier = modifier
+	k.keys = keys
 
-	dx := int8(math.Max(math.Min(float64(x), 127), -127))
-	dy := int8(math.Max(math.Min(float64(y), 127), -127))
+	return nil
+}
 
-	report := make([]byte, 3)
-	report[0] = byte(buttons & 0x07)
-	report[1] = byte(dx)
-	report[2] = byte(dy)
+// Send reports relative movement of the mouse.
+// Large movements are split into multiple reports and fractions are carried over to the next call.
+// Movements which do not fit in the report queue are carried over, too, but ErrQueueFull is returned if buttons are changed.
+func (m *USBGadgetMouse) Send(buttons int, x, y float64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	err = ioutil.WriteFile(dev, report, 0600)
+	m.remainderX += x
+	m.remainderY += y
 
-	return err
-}
+	dx := int(m.remainderX)
+	dy := int(m.remainderY)
+	m.remainderX -= float64(dx)
+	m.remainderY -= float64(dy)
 
-func (m *USBGadgetMouseAbsolute) Send(buttons, x, y int) error {
-	dev, err := m.Device.Get()
-	if err != nil {
-		return err
+	limit := 127
+	if m.highResolution {
+		limit = 32767
+	}
+
+	// send at least one report to update buttons
+	for first := true; first || dx != 0 || dy != 0; first = false {
+		rx := clamp(dx, -limit, limit)
+		ry := clamp(dy, -limit, limit)
+		dx -= rx
+		dy -= ry
+
+		var report []byte
+		if m.highResolution {
+			report = make([]byte, 5)
+			report[0] = byte(buttons & 0x07)
+			report[1] = byte(rx & 0xff)
+			report[2] = byte((rx >> 8) & 0xff)
+			report[3] = byte(ry & 0xff)
+			report[4] = byte((ry >> 8) & 0xff)
+		} else {
+			report = make([]byte, 3)
+			report[0] = byte(buttons & 0x07)
+			report[1] = byte(int8(rx))
+			report[2] = byte(int8(ry))
+		}
+
+		err := m.Device.Write(report, true)
+		if errors.Is(err, ErrQueueFull) {
+			// the host is not reading reports, the movement is sent with the next call
+			m.remainderX += float64(rx + dx)
+			m.remainderY += float64(ry + dy)
+			// a change of buttons (e.g. a click or the end of a drag) can not be merged into later movements
+			if int(report[0]) != m.buttons {
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m.buttons = int(report[0])
 	}
 
+	return nil
+}
+
+func (m *USBGadgetMouseAbsolute) Send(buttons, x, y int) error {
 	report := make([]byte, 6)
 	report[0] = byte(buttons & 0x07)
 	report[1] = 0 // padding
@@ -206,17 +365,10 @@ func (m *USBGadgetMouseAbsolute) Send(buttons, x, y int) error {
 	report[4] = byte(y & 0xff)
 	report[5] = byte((y >> 8) & 0xff)
 
-	err = ioutil.WriteFile(dev, report, 0600)
-
-	return err
+	return m.Device.Write(report, true)
 }
 
 func (m *USBGadgetTouchScreen) Send(buttons, x, y int) error {
-	dev, err := m.Device.Get()
-	if err != nil {
-		return err
-	}
-
 	report := make([]byte, 7)
 	report[0] = 1 // contact count
 	report[1] = 0 // contact identifier
@@ -226,17 +378,10 @@ func (m *USBGadgetTouchScreen) Send(buttons, x, y int) error {
 	report[5] = byte(y & 0xff)
 	report[6] = byte((y >> 8) & 0xff)
 
-	err = ioutil.WriteFile(dev, report, 0600)
-
-	return err
+	return m.Device.Write(report, true)
 }
 
 func (m *USBGadgetGamePad) Send(buttons []bool, axes []float64) error {
-	dev, err := m.Device.Get()
-	if err != nil {
-		return err
-	}
-
 	// hat switch mapping (Up, Down, Left, Right)
 	hatSwitchMap := []int{12, 13, 14, 15}
 
@@ -297,9 +442,8 @@ func (m *USBGadgetGamePad) Send(buttons []bool, axes []float64) error {
 		report[3+i] = byte((v + 1) / 2 * 255)
 	}
 
-	err = ioutil.WriteFile(dev, report, 0600)
-
-	return err
+	// gamepad state is sent periodically, so the latest one is enough
+	return m.Device.Write(report, true)
 }
 
 func (g USBGadget) AddMouse(name string) *USBGadgetMouse {
@@ -343,10 +487,70 @@ func (g USBGadget) AddMouse(name string) *USBGadgetMouse {
 		0xc0, //       [M] c0: End Collection
 		0xc0, //       [M] c0: End Collection
 	}
+
+	m := new(USBGadgetMouse)
+	m.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	m.Device.merge = mergeRelativeMouseReport
+	m.Device.lossless = true
+	f.Device = &m.Device
 	g.AddFunction(name, f)
 
+	return m
+}
+
+// AddMouseHighResolution adds a relative mouse with 16 bits movement fields.
+// This mouse does not support the boot protocol.
+func (g USBGadget) AddMouseHighResolution(name string) *USBGadgetMouse {
+	f := new(USBGadgetFunction)
+	f.Type = "hid"
+	f.Protocol = USB_PROTOCOL_NONE
+	f.SubClass = USB_SUBCLASS_NO_SUBCLASS
+	f.NoOutEndpoint = true
+	f.ReportLength = 5
+	f.ReportDescriptor = []byte{
+		0x05, 0x01, // [G] 05: Usage Page      (bSize = 1), 01: Generic Desktop
+		0x09, 0x02, // [L] 09: Usage           (bSize = 1), 02: Mouse (in Generic Desktop Page)
+		0xa1, 0x01, // [M] a1: Collection      (bSize = 1), 01: Application
+
+		0x09, 0x01, // [L] 09: Usage           (bSize = 1), 01: Pointer (in Generic Desktop Page)
+		0xa1, 0x00, // [M] a1: Collection      (bSize = 1), 00: Physical
+
+		// Input: buttons, 1 byte (1 bit/field * 3 fields + padding)
+		0x95, 0x03, // [G] 95: Report Count    (bSize = 1), 03: 3 fields
+		0x75, 0x01, // [G] 75: Report Size     (bSize = 1), 01: 1 bits/field
+		0x05, 0x09, // [G] 05: Usage Page      (bSize = 1), 09: Button
+		0x19, 0x01, // [L] 19: Usage Minimum   (bSize = 1), 01: Button 1, Selector (in Keyboard/Keypad Page)
+		0x29, 0x03, // [L] 29: Usage Maximum   (bSize = 1), 03: Button 3, Selector (in Keyboard/Keypad Page)
+		0x15, 0x00, // [G] 15: Logical Minimum (bSize = 1), 00: 0
+		0x25, 0x01, // [G] 25: Logical Maximum (bSize = 1), 01: 1
+		0x81, 0x02, // [M] 81: Input           (bSize = 1), 02: Variable, Data, Absolute
+		0x95, 0x01, // [G] 95: Report Count    (bSize = 1), 01: 1 fields
+		0x75, 0x05, // [G] 75: Report Size     (bSize = 1), 05: 5 bits/field
+		0x81, 0x01, // [M] 81: Input           (bSize = 1), 03: Constant (for padding)
+
+		// Input: X, Y, 4 byte (16 bits/field * 2 fields)
+		0x75, 0x10, // [G] 75: Report Size     (bSize = 1), 10: 16 bits/field
+		0x95, 0x02, // [G] 95: Report Count    (bSize = 1), 02: 2 fields
+		0x05, 0x01, // [G] 05: Usage Page      (bSize = 1), 01: Generic Desktop
+		0x09, 0x30, // [L] 09: Usage           (bSize = 1), 30: X, Dynamic Value (in Generic Desktop Page)
+		0x09, 0x31, // [L] 09: Usage           (bSize = 1), 31: Y, Dynamic Value (in Generic Desktop Page)
+		0x16,       // [G] 16: Logical Minimum (bSize = 2),
+		0x01, 0x80, //                                      8001: -32767
+		0x26,       // [G] 26: Logical Maximum (bSize = 2),
+		0xff, 0x7f, //                                      7fff: 32767
+		0x81, 0x06, // [M] 81: Input           (bSize = 1), 06: Variable, Data, Relative
+
+		0xc0, //       [M] c0: End Collection
+		0xc0, //       [M] c0: End Collection
+	}
+
 	m := new(USBGadgetMouse)
+	m.highResolution = true
 	m.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	m.Device.merge = mergeRelativeMouseReport16
+	m.Device.lossless = true
+	f.Device = &m.Device
+	g.AddFunction(name, f)
 
 	return m
 }
@@ -394,10 +598,12 @@ func (g USBGadget) AddMouseAbsolute(name string) *USBGadgetMouseAbsolute {
 
 		0xc0, //       [M] c0: End Collection
 	}
-	g.AddFunction(name, f)
 
 	mouseAbs := new(USBGadgetMouseAbsolute)
 	mouseAbs.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	mouseAbs.Device.merge = mergeAbsoluteReport(0)
+	f.Device = &mouseAbs.Device
+	g.AddFunction(name, f)
 
 	return mouseAbs
 }
@@ -461,10 +667,12 @@ func (g USBGadget) AddTouchScreen(name string) *USBGadgetTouchScreen {
 
 		0xc0, //       [M] c0: End Collection
 	}
-	g.AddFunction(name, f)
 
 	digitizer := new(USBGadgetTouchScreen)
 	digitizer.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	digitizer.Device.merge = mergeAbsoluteReport(2)
+	f.Device = &digitizer.Device
+	g.AddFunction(name, f)
 
 	return digitizer
 }
@@ -499,19 +707,23 @@ func (g USBGadget) AddKeyboard(name string) *USBGadgetKeyboard {
 		// Input: selected keys, 6 byte (8 bits/field * 6 fields)
 		0x05, 0x07, // [G] 05: Usage Page      (bSize = 1), 07: Keyboard/Keypad
 		0x19, 0x00, // [L] 19: Usage Minimum   (bSize = 1), 00: Reserved (no event indicated), Selector (in Keyboard/Keypad Page)
-		0x29, 0x65, // [L] 19: Usage Maximum   (bSize = 1), 65: Keyboard Application,          Selector (in Keyboard/Keypad Page)
+		0x29, 0xa4, // [L] 19: Usage Maximum   (bSize = 1), a4: Keyboard ExSel,                Selector (in Keyboard/Keypad Page)
 		0x15, 0x00, // [G] 15: Logical Minimum (bSize = 1), 00: 0
-		0x25, 0x65, // [G] 25: Logical Maximum (bSize = 1), 65: 101
+		0x26,       // [G] 26: Logical Maximum (bSize = 2),
+		0xa4, 0x00, //                                      00a4: 164
 		0x75, 0x08, // [G] 75: Report Size     (bsize = 1), 08: 8 bits/field
 		0x95, 0x06, // [G] 95: Report Count    (bSize = 1), 06: 6 fields
 		0x81, 0x00, // [M] 81: Input           (bSize = 1), 00: Array, Data
 
 		0xc0, //       [M] c0: End Collection
 	}
-	g.AddFunction(name, f)
 
 	k := new(USBGadgetKeyboard)
 	k.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	// a dropped report loses a keystroke
+	k.Device.lossless = true
+	f.Device = &k.Device
+	g.AddFunction(name, f)
 
 	return k
 }
@@ -584,10 +796,12 @@ func (g USBGadget) AddGamePad(name string) *USBGadgetGamePad {
 
 		0xc0, //       [M] c0: End Collection
 	}
-	g.AddFunction(name, f)
 
 	gamepad := new(USBGadgetGamePad)
 	gamepad.Device.ConfigDir = getConfigDir(g.Name) + fmt.Sprintf("/%s.%s", f.Type, name)
+	gamepad.Device.merge = replaceReport
+	f.Device = &gamepad.Device
+	g.AddFunction(name, f)
 
 	return gamepad
 }
@@ -596,6 +810,18 @@ func (g USBGadget) AddFunction(name string, f *USBGadgetFunction) {
 	g.Functions[name] = f
 }
 
+// Stats returns report writer statistics of each function.
+func (g USBGadget) Stats() map[string]HIDStats {
+	stats := map[string]HIDStats{}
+	for n, f := range g.Functions {
+		if f.Device != nil {
+			stats[n] = f.Device.Stats()
+		}
+	}
+
+	return stats
+}
+
 func (g USBGadget) Start() {
 	gadgetDir := getGadgetDir(g.Name)
 
@@ -619,37 +845,109 @@ func (g USBGadget) Start() {
 
 	configDir := getConfigDir(g.Name)
 	os.Mkdir(configDir, 0755)
+	ioutil.WriteFile(configDir+"/bmAttributes", []byte(strconv.Itoa(g.Attributes)), 0644)
 
 	// create function directories
 	for n, f := range g.Functions {
 		functionDir := gadgetDir + "/functions/" + fmt.Sprintf("%s.%s", f.Type, n)
 
 		os.Mkdir(functionDir, 0755)
-		ioutil.WriteFile(functionDir+"/protocol", []byte(strconv.Itoa(f.Protocol)), 0644)
-		ioutil.WriteFile(functionDir+"/subclass", []byte(strconv.Itoa(f.SubClass)), 0644)
-		ioutil.WriteFile(functionDir+"/report_length", []byte(strconv.Itoa(f.ReportLength)), 0644)
-		ioutil.WriteFile(functionDir+"/report_desc", f.ReportDescriptor, 0644)
-
-		// use no_out_endpoint option if supported
-		if _, err := os.Stat(functionDir + "/no_out_endpoint"); err == nil && f.NoOutEndpoint == true {
-			ioutil.WriteFile(functionDir+"/no_out_endpoint", []byte("1"), 0644)
+		switch f.Type {
+		case "hid":
+			ioutil.WriteFile(functionDir+"/protocol", []byte(strconv.Itoa(f.Protocol)), 0644)
+			ioutil.WriteFile(functionDir+"/subclass", []byte(strconv.Itoa(f.SubClass)), 0644)
+			ioutil.WriteFile(functionDir+"/report_length", []byte(strconv.Itoa(f.ReportLength)), 0644)
+			ioutil.WriteFile(functionDir+"/report_desc", f.ReportDescriptor, 0644)
+
+			// use no_out_endpoint option if supported
+			if _, err := os.Stat(functionDir + "/no_out_endpoint"); err == nil && f.NoOutEndpoint == true {
+				ioutil.WriteFile(functionDir+"/no_out_endpoint", []byte("1"), 0644)
+			}
+		case "mass_storage":
+			// media can be changed while the gadget is attached
+			ioutil.WriteFile(functionDir+"/lun.0/removable", []byte("1"), 0644)
 		}
 
 		os.Symlink(functionDir, configDir+fmt.Sprintf("/%s.%s", f.Type, n))
 	}
 
 	// use first one
-	files, _ := ioutil.ReadDir("/sys/class/udc")
+	files, _ := ioutil.ReadDir(udcDir)
 	udc := filepath.Base(files[0].Name())
 
 	// attach to usb device controller
 	ioutil.WriteFile(gadgetDir+"/UDC", []byte(udc), 0644)
+
+	// wait for device nodes here, not to block writes of reports
+	deadline := time.Now().Add(HID_DEVICE_TIMEOUT)
+	for _, f := range g.Functions {
+		if f.Device != nil {
+			f.Device.WaitReady(deadline)
+		}
+	}
+}
+
+func (g USBGadget) getUDC() (string, error) {
+	data, err := ioutil.ReadFile(getGadgetDir(g.Name) + "/UDC")
+	if err != nil {
+		return "", err
+	}
+
+	udc := strings.TrimSpace(string(data))
+	if len(udc) == 0 {
+		return "", errors.New("gadget is not attached to UDC")
+	}
+
+	return udc, nil
+}
+
+// State returns the state of the attached UDC (e.g. "configured", "suspended").
+func (g USBGadget) State() (string, error) {
+	udc, err := g.getUDC()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(udcDir + "/" + udc + "/state")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (g USBGadget) IsSuspended() bool {
+	state, err := g.State()
+	if err != nil {
+		return false
+	}
+
+	return state == "suspended"
+}
+
+// Wakeup sends a remote wakeup signal to the host.
+// The host must have enabled remote wakeup before it was suspended.
+func (g USBGadget) Wakeup() error {
+	udc, err := g.getUDC()
+	if err != nil {
+		return err
+	}
+
+	// writing to srp calls usb_gadget_wakeup() of the UDC driver
+	return ioutil.WriteFile(udcDir+"/"+udc+"/srp", []byte("1"), 0200)
 }
 
 func (g USBGadget) Stop() {
 	gadgetDir := getGadgetDir(g.Name)
 	configDir := getConfigDir(g.Name)
 
+	// close devices
+	for _, f := range g.Functions {
+		if f.Device != nil {
+			f.Device.Close()
+		}
+	}
+
 	// detach from usb device controller
 	ioutil.WriteFile(gadgetDir+"/UDC", []byte("\n"), 0644)
 
@@ -675,6 +973,7 @@ func NewUSBGadget(name string) *USBGadget {
 	g.IdProduct = USB_PRODUCT_ID
 	g.UsbVersion = USB_VERSION
 	g.DeviceVesion = USB_DEVICE_VERSION
+	g.Attributes = USB_CONFIG_ATTR_ONE | USB_CONFIG_ATTR_REMOTE_WAKEUP
 	g.Strings = map[int]*USBGadgetStringDescriptor{}
 	g.Strings[USB_DESC_LANG_ID] = &USBGadgetStringDescriptor{
 		SerialNumber: USB_DESC_SERIAL,
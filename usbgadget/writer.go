@@ -0,0 +1,290 @@
+package usbgadget
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+/* report writer settings */
+const (
+	HID_QUEUE_LENGTH  int           = 64
+	HID_WRITE_TIMEOUT time.Duration = 500 * time.Millisecond
+)
+
+type HIDStats struct {
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+	Timeouts  uint64 `json:"timeouts"`
+	Errors    uint64 `json:"errors"`
+}
+
+// ErrQueueFull is returned if the report can not be queued. The caller should send it later.
+var ErrQueueFull = errors.New("HID report queue full")
+
+type hidReport struct {
+	data     []byte
+	coalesce bool
+}
+
+// mergeFunc merges two queued reports into one.
+// It returns false if the reports can not be merged.
+type mergeFunc func(prev, next []byte) ([]byte, bool)
+
+func (d *USBGadgetDevice) open() error {
+	if d.file != nil {
+		return nil
+	}
+
+	dev, err := d.Get()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	d.file = file
+
+	if d.wake == nil {
+		d.wake = make(chan struct{}, 1)
+		d.closing = make(chan struct{})
+		d.done = make(chan struct{})
+		go d.run()
+	}
+
+	return nil
+}
+
+// Write queues a report. The report is written by the writer goroutine of the device.
+// If coalesce is true, the report may be merged into the last queued report.
+// If the queue is full, the oldest report which can be coalesced is dropped.
+// ErrQueueFull is returned by lossless devices, or if no report can be dropped (e.g. button changes).
+func (d *USBGadgetDevice) Write(report []byte, coalesce bool) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return errors.New("device closed")
+	}
+
+	err := d.open()
+	if err != nil {
+		return err
+	}
+
+	n := len(d.queue)
+	if coalesce && n > 0 && d.queue[n-1].coalesce && d.merge != nil {
+		if merged, ok := d.merge(d.queue[n-1].data, report); ok {
+			d.queue[n-1].data = merged
+			d.stats.Coalesced++
+			return nil
+		}
+	}
+
+	if n >= HID_QUEUE_LENGTH && !d.compact() && (d.lossless || !d.dropOldest()) {
+		return ErrQueueFull
+	}
+	d.queue = append(d.queue, hidReport{data: report, coalesce: coalesce})
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// writer is already notified
+	}
+
+	return nil
+}
+
+// compact merges the oldest pair of adjacent reports which can be merged, to keep movements of relative reports in the full queue.
+// It returns false if no reports can be merged. It must be called with the lock.
+func (d *USBGadgetDevice) compact() bool {
+	if d.merge == nil {
+		return false
+	}
+
+	for i := 0; i+1 < len(d.queue); i++ {
+		if !d.queue[i].coalesce || !d.queue[i+1].coalesce {
+			continue
+		}
+		merged, ok := d.merge(d.queue[i].data, d.queue[i+1].data)
+		if !ok {
+			continue
+		}
+		d.queue[i].data = merged
+		d.queue = append(d.queue[:i+1], d.queue[i+2:]...)
+		d.stats.Coalesced++
+		return true
+	}
+
+	return false
+}
+
+// dropOldest drops the oldest report which can be coalesced, it is superseded by a newer report.
+// It returns false if no reports can be dropped. It must be called with the lock.
+func (d *USBGadgetDevice) dropOldest() bool {
+	for i, r := range d.queue {
+		if r.coalesce {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			d.stats.Dropped++
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *USBGadgetDevice) dequeue() (hidReport, *os.File, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed || len(d.queue) == 0 {
+		return hidReport{}, nil, false
+	}
+
+	if err := d.open(); err != nil {
+		d.stats.Dropped += uint64(len(d.queue))
+		d.queue = nil
+		return hidReport{}, nil, false
+	}
+
+	r := d.queue[0]
+	d.queue = d.queue[1:]
+
+	return r, d.file, true
+}
+
+func (d *USBGadgetDevice) write(file *os.File, r hidReport) {
+	// the deadline is not supported if the device can not be polled
+	deadline := file.SetWriteDeadline(time.Now().Add(HID_WRITE_TIMEOUT)) == nil
+
+	_, err := file.Write(r.data)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch {
+	case err == nil:
+		d.stats.Sent++
+	case deadline && errors.Is(err, os.ErrDeadlineExceeded):
+		// host is not polling the endpoint (e.g. suspended)
+		d.stats.Timeouts++
+	default:
+		// reopen the device at the next report
+		d.stats.Errors++
+		if d.file == file {
+			d.file.Close()
+			d.file = nil
+		}
+	}
+}
+
+func (d *USBGadgetDevice) run() {
+	defer close(d.done)
+
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-d.wake:
+		}
+
+		for {
+			r, file, ok := d.dequeue()
+			if !ok {
+				break
+			}
+			d.write(file, r)
+		}
+	}
+}
+
+func (d *USBGadgetDevice) Stats() HIDStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.stats
+}
+
+// Close stops the writer goroutine and closes the device.
+// Queued reports are discarded.
+func (d *USBGadgetDevice) Close() {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return
+	}
+	d.closed = true
+	d.queue = nil
+	// closing the file also unblocks a pending write
+	if d.file != nil {
+		d.file.Close()
+		d.file = nil
+	}
+	d.mutex.Unlock()
+
+	if d.closing != nil {
+		close(d.closing)
+		<-d.done
+	}
+}
+
+// mergeRelativeMouseReport adds movements of two reports with the same buttons.
+func mergeRelativeMouseReport(prev, next []byte) ([]byte, bool) {
+	if prev[0] != next[0] {
+		return nil, false
+	}
+
+	dx := int(int8(prev[1])) + int(int8(next[1]))
+	dy := int(int8(prev[2])) + int(int8(next[2]))
+	if dx < -127 || 127 < dx || dy < -127 || 127 < dy {
+		return nil, false
+	}
+
+	merged := make([]byte, len(prev))
+	merged[0] = prev[0]
+	merged[1] = byte(int8(dx))
+	merged[2] = byte(int8(dy))
+
+	return merged, true
+}
+
+// mergeRelativeMouseReport16 is mergeRelativeMouseReport for 16 bits movement fields.
+func mergeRelativeMouseReport16(prev, next []byte) ([]byte, bool) {
+	if prev[0] != next[0] {
+		return nil, false
+	}
+
+	dx := int(int16(uint16(prev[1])|uint16(prev[2])<<8)) + int(int16(uint16(next[1])|uint16(next[2])<<8))
+	dy := int(int16(uint16(prev[3])|uint16(prev[4])<<8)) + int(int16(uint16(next[3])|uint16(next[4])<<8))
+	if dx < -32767 || 32767 < dx || dy < -32767 || 32767 < dy {
+		return nil, false
+	}
+
+	merged := make([]byte, len(prev))
+	merged[0] = prev[0]
+	merged[1] = byte(dx & 0xff)
+	merged[2] = byte((dx >> 8) & 0xff)
+	merged[3] = byte(dy & 0xff)
+	merged[4] = byte((dy >> 8) & 0xff)
+
+	return merged, true
+}
+
+// mergeAbsoluteReport replaces a position report with a newer one with the same buttons.
+func mergeAbsoluteReport(buttonsIndex int) mergeFunc {
+	return func(prev, next []byte) ([]byte, bool) {
+		if prev[buttonsIndex] != next[buttonsIndex] {
+			return nil, false
+		}
+
+		return next, true
+	}
+}
+
+// replaceReport replaces a report with a newer one.
+func replaceReport(prev, next []byte) ([]byte, bool) {
+	return next, true
+}
@@ -0,0 +1,134 @@
+package v4l2
+
+import (
+	"math"
+	"syscall"
+	"unsafe"
+)
+
+// Capability is the identification of the device.
+type Capability struct {
+	Driver  string `json:"driver"`
+	Card    string `json:"card"`
+	BusInfo string `json:"busInfo"`
+}
+
+// Format is a pixel format supported by the device.
+type Format struct {
+	PixelFormat string      `json:"pixelFormat"`
+	Description string      `json:"description"`
+	Sizes       []FrameSize `json:"sizes"`
+}
+
+// FrameSize is a frame size and frame rates supported in the format.
+// Only the maximum size is listed if the device supports a range of sizes.
+type FrameSize struct {
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Framerates []float64 `json:"framerates"`
+}
+
+func (d *Device) Capability() (Capability, error) {
+	c := capability{}
+	err := d.ioctl(vidiocQueryCap, unsafe.Pointer(&c))
+	if err != nil {
+		return Capability{}, err
+	}
+
+	return Capability{
+		Driver:  cString(c.Driver[:]),
+		Card:    cString(c.Card[:]),
+		BusInfo: cString(c.BusInfo[:]),
+	}, nil
+}
+
+// Formats enumerates pixel formats, frame sizes and frame rates of video capture.
+func (d *Device) Formats() ([]Format, error) {
+	formats := []Format{}
+	for i := uint32(0); ; i++ {
+		desc := fmtDesc{Index: i, Type: bufTypeVideoCapture}
+		err := d.ioctl(vidiocEnumFmt, unsafe.Pointer(&desc))
+		if err == syscall.EINVAL {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sizes, err := d.frameSizes(desc.PixelFormat)
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, Format{
+			PixelFormat: FourCC(desc.PixelFormat),
+			Description: cString(desc.Description[:]),
+			Sizes:       sizes,
+		})
+	}
+
+	return formats, nil
+}
+
+func (d *Device) frameSizes(pixelFormat uint32) ([]FrameSize, error) {
+	sizes := []FrameSize{}
+	for i := uint32(0); ; i++ {
+		e := frmSizeEnum{Index: i, PixelFormat: pixelFormat}
+		err := d.ioctl(vidiocEnumFrameSizes, unsafe.Pointer(&e))
+		if err == syscall.EINVAL {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		width, height := e.Size[0], e.Size[1]
+		if e.Type != frmSizeTypeDiscrete {
+			width, height = e.Size[1], e.Size[4]
+		}
+		framerates, err := d.framerates(pixelFormat, width, height)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, FrameSize{Width: int(width), Height: int(height), Framerates: framerates})
+
+		if e.Type != frmSizeTypeDiscrete {
+			break
+		}
+	}
+
+	return sizes, nil
+}
+
+// framerates returns frame rates from the highest, the minimum and maximum are listed for a range.
+func (d *Device) framerates(pixelFormat, width, height uint32) ([]float64, error) {
+	framerates := []float64{}
+	for i := uint32(0); ; i++ {
+		e := frmIvalEnum{Index: i, PixelFormat: pixelFormat, Width: width, Height: height}
+		err := d.ioctl(vidiocEnumFrameIntervals, unsafe.Pointer(&e))
+		if err == syscall.EINVAL {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Type == frmIvalTypeDiscrete {
+			framerates = append(framerates, framerate(e.Interval[0]))
+			continue
+		}
+		// the minimum interval is the maximum frame rate
+		framerates = append(framerates, framerate(e.Interval[0]), framerate(e.Interval[1]))
+		break
+	}
+
+	return framerates, nil
+}
+
+// framerate converts the interval (sec) to frames per second, rounded to 2 decimal places.
+func framerate(interval fraction) float64 {
+	if interval.Numerator == 0 {
+		return 0
+	}
+
+	return math.Round(float64(interval.Denominator)/float64(interval.Numerator)*100) / 100
+}
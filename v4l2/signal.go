@@ -0,0 +1,77 @@
+package v4l2
+
+import (
+	"encoding/binary"
+	"math"
+	"syscall"
+	"unsafe"
+)
+
+// Signal is the state of the input signal.
+type Signal struct {
+	// false if the device does not report the signal (e.g. UVC devices), other fields are not available
+	Detectable bool `json:"detectable"`
+	// a stable signal is received
+	Locked bool `json:"locked"`
+	// timings detected by HDMI receivers, 0 if they are not reported
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Framerate float64 `json:"framerate"`
+}
+
+// Signal detects the input signal by DV timings (HDMI receivers), or the status of the current input.
+func (d *Device) Signal() (Signal, error) {
+	t := dvTimings{}
+	err := d.ioctl(vidiocQueryDVTimings, unsafe.Pointer(&t))
+	switch err {
+	case nil:
+		if t.Type == dvBTTimings {
+			return btSignal(t.BT[:]), nil
+		}
+	case syscall.ENOLINK, syscall.ENOLCK, syscall.ERANGE:
+		// no signal, unstable or out of range
+		return Signal{Detectable: true}, nil
+	}
+
+	index := uint32(0)
+	err = d.ioctl(vidiocGInput, unsafe.Pointer(&index))
+	if err == syscall.ENOTTY {
+		return Signal{}, nil
+	}
+	if err != nil {
+		return Signal{}, err
+	}
+	in := input{Index: index}
+	err = d.ioctl(vidiocEnumInput, unsafe.Pointer(&in))
+	if err != nil {
+		return Signal{}, err
+	}
+
+	if in.Status&(inStatusNoPower|inStatusNoSignal|inStatusNoHLock|inStatusNoSync) != 0 {
+		return Signal{Detectable: true}, nil
+	}
+
+	// most devices do not set the status, it does not mean the signal is received
+	return Signal{}, nil
+}
+
+// btSignal decodes struct v4l2_bt_timings.
+func btSignal(bt []byte) Signal {
+	u32 := func(offset int) uint64 { return uint64(binary.LittleEndian.Uint32(bt[offset:])) }
+
+	width, height := u32(0), u32(4)
+	interlaced := u32(8) != 0
+	pixelClock := binary.LittleEndian.Uint64(bt[16:])
+	hTotal := width + u32(24) + u32(28) + u32(32)
+	vTotal := height + u32(36) + u32(40) + u32(44)
+	if interlaced {
+		vTotal += u32(48) + u32(52) + u32(56)
+	}
+
+	s := Signal{Detectable: true, Locked: true, Width: int(width), Height: int(height)}
+	if hTotal > 0 && vTotal > 0 {
+		s.Framerate = math.Round(float64(pixelClock)/float64(hTotal*vTotal)*100) / 100
+	}
+
+	return s
+}
@@ -0,0 +1,60 @@
+package v4l2
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// btTimings encodes struct v4l2_bt_timings.
+func btTimings(width, height uint32, interlaced bool, pixelClock uint64, hBlank, vBlank, ilVBlank [3]uint32) []byte {
+	bt := make([]byte, 128)
+	binary.LittleEndian.PutUint32(bt[0:], width)
+	binary.LittleEndian.PutUint32(bt[4:], height)
+	if interlaced {
+		binary.LittleEndian.PutUint32(bt[8:], 1)
+	}
+	binary.LittleEndian.PutUint64(bt[16:], pixelClock)
+	for i := 0; i < 3; i++ {
+		binary.LittleEndian.PutUint32(bt[24+i*4:], hBlank[i])
+		binary.LittleEndian.PutUint32(bt[36+i*4:], vBlank[i])
+		binary.LittleEndian.PutUint32(bt[48+i*4:], ilVBlank[i])
+	}
+
+	return bt
+}
+
+func TestBTSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		bt   []byte
+		want Signal
+	}{
+		{
+			"1080p60",
+			btTimings(1920, 1080, false, 148500000, [3]uint32{88, 44, 148}, [3]uint32{4, 5, 36}, [3]uint32{}),
+			Signal{Detectable: true, Locked: true, Width: 1920, Height: 1080, Framerate: 60},
+		},
+		{
+			"720p59.94",
+			btTimings(1280, 720, false, 74175824, [3]uint32{110, 40, 220}, [3]uint32{5, 5, 20}, [3]uint32{}),
+			Signal{Detectable: true, Locked: true, Width: 1280, Height: 720, Framerate: 59.94},
+		},
+		{
+			// blanking of the second field is added to the frame
+			"1080i60",
+			btTimings(1920, 1080, true, 74250000, [3]uint32{88, 44, 148}, [3]uint32{2, 5, 15}, [3]uint32{2, 5, 16}),
+			Signal{Detectable: true, Locked: true, Width: 1920, Height: 1080, Framerate: 30},
+		},
+		{
+			"zero totals",
+			btTimings(0, 0, false, 148500000, [3]uint32{}, [3]uint32{}, [3]uint32{}),
+			Signal{Detectable: true, Locked: true},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := btSignal(tt.bt); got != tt.want {
+			t.Errorf("%s: btSignal() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
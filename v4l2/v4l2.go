@@ -0,0 +1,148 @@
+// Package v4l2 queries capabilities and the input signal of V4L2 capture devices.
+package v4l2
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl requests (linux/videodev2.h)
+var (
+	vidiocQueryCap           = ior('V', 0, unsafe.Sizeof(capability{}))
+	vidiocEnumFmt            = iowr('V', 2, unsafe.Sizeof(fmtDesc{}))
+	vidiocEnumInput          = iowr('V', 26, unsafe.Sizeof(input{}))
+	vidiocGInput             = ior('V', 38, unsafe.Sizeof(uint32(0)))
+	vidiocEnumFrameSizes     = iowr('V', 74, unsafe.Sizeof(frmSizeEnum{}))
+	vidiocEnumFrameIntervals = iowr('V', 75, unsafe.Sizeof(frmIvalEnum{}))
+	vidiocQueryDVTimings     = ior('V', 99, unsafe.Sizeof(dvTimings{}))
+)
+
+const (
+	bufTypeVideoCapture = 1
+
+	frmSizeTypeDiscrete = 1
+	frmIvalTypeDiscrete = 1
+
+	dvBTTimings = 0
+
+	inStatusNoPower  = 0x00000001
+	inStatusNoSignal = 0x00000002
+	inStatusNoHLock  = 0x00000100
+	inStatusNoSync   = 0x00010000
+)
+
+type capability struct {
+	Driver       [16]byte
+	Card         [32]byte
+	BusInfo      [32]byte
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type fmtDesc struct {
+	Index       uint32
+	Type        uint32
+	Flags       uint32
+	Description [32]byte
+	PixelFormat uint32
+	Reserved    [4]uint32
+}
+
+type frmSizeEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Type        uint32
+	// discrete: width, height; stepwise: min_width, max_width, step_width, min_height, max_height, step_height
+	Size     [6]uint32
+	Reserved [2]uint32
+}
+
+type fraction struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type frmIvalEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Width       uint32
+	Height      uint32
+	Type        uint32
+	// discrete: the interval; stepwise: min, max, step
+	Interval [3]fraction
+	Reserved [2]uint32
+}
+
+type input struct {
+	Index        uint32
+	Name         [32]byte
+	Type         uint32
+	AudioSet     uint32
+	Tuner        uint32
+	Std          uint64
+	Status       uint32
+	Capabilities uint32
+	Reserved     [3]uint32
+	// the kernel aligns Std to 8 bytes on ARM EABI, the struct is padded to 80 bytes
+	_ uint32
+}
+
+// dvTimings is packed in the kernel, BT timings are decoded from bytes.
+type dvTimings struct {
+	Type uint32
+	BT   [128]byte
+}
+
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | typ<<8 | nr
+}
+
+func ior(typ, nr, size uintptr) uintptr  { return ioc(2, typ, nr, size) }
+func iowr(typ, nr, size uintptr) uintptr { return ioc(3, typ, nr, size) }
+
+// Device is an opened V4L2 device.
+type Device struct {
+	file *os.File
+}
+
+func Open(path string) (*Device, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Device{file: file}, nil
+}
+
+func (d *Device) Close() error {
+	return d.file.Close()
+}
+
+func (d *Device) ioctl(request uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), request, uintptr(arg))
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// FourCC returns the pixel format as a string (e.g. MJPG).
+func FourCC(pixelFormat uint32) string {
+	return string([]byte{byte(pixelFormat), byte(pixelFormat >> 8), byte(pixelFormat >> 16), byte(pixelFormat >> 24)})
+}
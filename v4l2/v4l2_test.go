@@ -0,0 +1,34 @@
+package v4l2
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// sizes of structs in linux/videodev2.h, they are encoded in ioctl requests
+func TestStructSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		size uintptr
+		want uintptr
+	}{
+		{"v4l2_capability", unsafe.Sizeof(capability{}), 104},
+		{"v4l2_fmtdesc", unsafe.Sizeof(fmtDesc{}), 64},
+		{"v4l2_frmsizeenum", unsafe.Sizeof(frmSizeEnum{}), 44},
+		{"v4l2_frmivalenum", unsafe.Sizeof(frmIvalEnum{}), 52},
+		{"v4l2_input", unsafe.Sizeof(input{}), 80},
+		{"v4l2_dv_timings", unsafe.Sizeof(dvTimings{}), 132},
+	}
+
+	for _, tt := range tests {
+		if tt.size != tt.want {
+			t.Errorf("size of %s = %d, want %d", tt.name, tt.size, tt.want)
+		}
+	}
+}
+
+func TestInputStdOffset(t *testing.T) {
+	if offset := unsafe.Offsetof(input{}.Std); offset != 48 {
+		t.Errorf("offset of std in v4l2_input = %d, want 48", offset)
+	}
+}
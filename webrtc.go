@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// av1PayloadType is not used by the default codecs.
+const av1PayloadType = 45
+
+// newPeerConnection returns the peer connection with the default codecs and AV1,
+// and the bandwidth estimator which is fed by TWCC feedback of the browser.
+func newPeerConnection(config webrtc.Configuration, initialBitrate int) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	m := &webrtc.MediaEngine{}
+	err := m.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeAV1,
+			ClockRate: 90000,
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"},
+			},
+		},
+		PayloadType: av1PayloadType,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i := &interceptor.Registry{}
+	err = webrtc.RegisterDefaultInterceptors(m, i)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the encoder follows the estimate, packets are not paced
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// called while creating the peer connection
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(id string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+
+	err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pc, estimator, nil
+}
+
+// readRTCP reads RTCP packets from the browser until the sender is closed.
+// Packets are also processed by interceptors (NACK and TWCC) while reading.
+// The browser requests a keyframe by PLI or FIR when it can not decode the stream after packet loss.
+func readRTCP(c *KVMContext, s *MediaStream, sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				s.SetEstimate(c, "remb", int(p.Bitrate))
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.RequestKeyframe()
+			}
+		}
+	}
+}